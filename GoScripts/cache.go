@@ -0,0 +1,196 @@
+package main
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cacheShards is the number of independently locked LRU lists. Keys are
+// spread across shards by hash so concurrent searches rarely contend.
+const cacheShards = 16
+
+// Cache is a sharded LRU cache with a memory budget. Each shard evicts its
+// least recently used entries once it goes over its share of the budget,
+// and a background janitor removes expired entries that are never read.
+type Cache[V any] struct {
+	shards [cacheShards]*cacheShard[V]
+	sizeOf func(key string, value V) int
+	stop   chan struct{}
+
+	hits        atomic.Int64
+	misses      atomic.Int64
+	evictions   atomic.Int64
+	expirations atomic.Int64
+}
+
+type cacheShard[V any] struct {
+	mutex  sync.Mutex
+	items  map[string]*list.Element
+	order  *list.List // front is most recently used
+	bytes  int
+	budget int
+}
+
+type cacheEntry[V any] struct {
+	key        string
+	value      V
+	size       int
+	expiration time.Time
+}
+
+// CacheStats is a point-in-time view of the cache counters.
+type CacheStats struct {
+	Entries     int   `json:"entries"`
+	Bytes       int   `json:"bytes"`
+	MaxBytes    int   `json:"max_bytes"`
+	Hits        int64 `json:"hits"`
+	Misses      int64 `json:"misses"`
+	Evictions   int64 `json:"evictions"`
+	Expirations int64 `json:"expirations"`
+}
+
+// NewCache creates a cache holding at most maxBytes, as estimated by sizeOf,
+// and starts a janitor that sweeps expired entries every janitorInterval.
+func NewCache[V any](maxBytes int, janitorInterval time.Duration, sizeOf func(key string, value V) int) *Cache[V] {
+	c := &Cache[V]{
+		sizeOf: sizeOf,
+		stop:   make(chan struct{}),
+	}
+	for i := range c.shards {
+		c.shards[i] = &cacheShard[V]{
+			items:  make(map[string]*list.Element),
+			order:  list.New(),
+			budget: maxBytes / cacheShards,
+		}
+	}
+	if janitorInterval > 0 {
+		go c.janitor(janitorInterval)
+	}
+	return c
+}
+
+func (c *Cache[V]) shard(key string) *cacheShard[V] {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return c.shards[h.Sum32()%cacheShards]
+}
+
+func (c *Cache[V]) Set(key string, value V, duration time.Duration) {
+	size := c.sizeOf(key, value)
+	s := c.shard(key)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if el, found := s.items[key]; found {
+		s.remove(el)
+	}
+
+	// An entry bigger than the whole shard would only evict everything
+	// else and then itself
+	if size > s.budget {
+		return
+	}
+
+	s.items[key] = s.order.PushFront(&cacheEntry[V]{
+		key:        key,
+		value:      value,
+		size:       size,
+		expiration: time.Now().Add(duration),
+	})
+	s.bytes += size
+
+	for s.bytes > s.budget {
+		s.remove(s.order.Back())
+		c.evictions.Add(1)
+	}
+}
+
+func (c *Cache[V]) Get(key string) (V, bool) {
+	s := c.shard(key)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var zero V
+	el, found := s.items[key]
+	if !found {
+		c.misses.Add(1)
+		return zero, false
+	}
+	entry := el.Value.(*cacheEntry[V])
+	if time.Now().After(entry.expiration) {
+		s.remove(el)
+		c.expirations.Add(1)
+		c.misses.Add(1)
+		return zero, false
+	}
+
+	s.order.MoveToFront(el)
+	c.hits.Add(1)
+	return entry.value, true
+}
+
+func (c *Cache[V]) Stats() CacheStats {
+	stats := CacheStats{
+		Hits:        c.hits.Load(),
+		Misses:      c.misses.Load(),
+		Evictions:   c.evictions.Load(),
+		Expirations: c.expirations.Load(),
+	}
+	for _, s := range c.shards {
+		s.mutex.Lock()
+		stats.Entries += len(s.items)
+		stats.Bytes += s.bytes
+		stats.MaxBytes += s.budget
+		s.mutex.Unlock()
+	}
+	return stats
+}
+
+// Close stops the janitor.
+func (c *Cache[V]) Close() {
+	close(c.stop)
+}
+
+func (c *Cache[V]) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.sweep(time.Now())
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// sweep removes expired entries one shard at a time, so searches on other
+// shards are never blocked by it.
+func (c *Cache[V]) sweep(now time.Time) {
+	for _, s := range c.shards {
+		s.mutex.Lock()
+		for el := s.order.Back(); el != nil; {
+			prev := el.Prev()
+			if now.After(el.Value.(*cacheEntry[V]).expiration) {
+				s.remove(el)
+				c.expirations.Add(1)
+			}
+			el = prev
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// remove unlinks an entry; the caller must hold the shard lock.
+func (s *cacheShard[V]) remove(el *list.Element) {
+	entry := el.Value.(*cacheEntry[V])
+	s.order.Remove(el)
+	delete(s.items, entry.key)
+	s.bytes -= entry.size
+}
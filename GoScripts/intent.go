@@ -0,0 +1,150 @@
+package main
+
+import (
+	"database/sql"
+	"log/slog"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Query intents recognized by the classifier
+const (
+	intentCompanyNumber = "company_number"
+	intentPostcode      = "postcode"
+	intentCity          = "city"
+	intentName          = "name"
+)
+
+var (
+	// Company numbers are "GB" followed by digits, e.g. GB000000001234
+	companyNumberPattern = regexp.MustCompile(`^GB[0-9]+$`)
+
+	// Full UK postcodes, with or without the space: "LS1 4AP", "SW1A1AA"
+	postcodePattern = regexp.MustCompile(`^([A-Z]{1,2}[0-9][A-Z0-9]?) ?([0-9][A-Z]{2})$`)
+
+	// Outward code on its own, e.g. "LS1" or "SW1A"
+	outwardCodePattern = regexp.MustCompile(`^[A-Z]{1,2}[0-9][A-Z0-9]?$`)
+)
+
+// searchStrategy is one prepared statement to run for a query, with the
+// arguments to bind and the weight its results carry when merged.
+type searchStrategy struct {
+	name   string
+	stmt   statement
+	args   []interface{}
+	weight float64
+}
+
+// statement is a prepared statement with its SQL, for the slow query log.
+type statement struct {
+	*sql.Stmt
+	sql string
+}
+
+// prepareStatement prepares query, keeping it on one line for logs.
+func prepareStatement(db *sql.DB, query string) (statement, error) {
+	stmt, err := db.Prepare(query)
+	return statement{Stmt: stmt, sql: strings.Join(strings.Fields(query), " ")}, err
+}
+
+// searchStatements holds the prepared statements the router chooses from.
+type searchStatements struct {
+	name   statement
+	id     statement
+	city   statement
+	postal statement
+}
+
+// cityIndex is the set of known city names, lowercased. It is loaded once
+// at startup and only read afterwards.
+type cityIndex map[string]bool
+
+func loadCityIndex(db *sql.DB, limit int) cityIndex {
+	cities := make(cityIndex)
+	rows, err := db.Query("SELECT DISTINCT city FROM search WHERE city IS NOT NULL AND city <> '' LIMIT ?", limit)
+	if err != nil {
+		slog.Warn("Could not load city names, city routing disabled", "error", err)
+		return cities
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var city string
+		if err := rows.Scan(&city); err != nil {
+			slog.Warn("City scan error", "error", err)
+			continue
+		}
+		cities[strings.ToLower(strings.TrimSpace(city))] = true
+	}
+	return cities
+}
+
+// classifyIntent works out what the user is looking for from the shape of
+// the query alone.
+func classifyIntent(query string, cities cityIndex) string {
+	trimmed := strings.TrimSpace(query)
+	upper := strings.ToUpper(trimmed)
+
+	switch {
+	case companyNumberPattern.MatchString(upper):
+		return intentCompanyNumber
+	case postcodePattern.MatchString(upper), outwardCodePattern.MatchString(upper):
+		return intentPostcode
+	case cities[strings.ToLower(trimmed)]:
+		return intentCity
+	default:
+		return intentName
+	}
+}
+
+// classifyQuery returns the query's intent and the strategies worth running
+// for it. Only free text goes to FULLTEXT on name; postcodes, company
+// numbers and cities use their own indexes. A city query also searches
+// names at a lower weight, since companies are often named after places.
+func classifyQuery(query string, stmts searchStatements, cities cityIndex) (string, []searchStrategy) {
+	trimmed := strings.TrimSpace(query)
+	upper := strings.ToUpper(trimmed)
+
+	intent := classifyIntent(query, cities)
+	switch intent {
+	case intentCompanyNumber:
+		return intent, []searchStrategy{
+			{name: "id", stmt: stmts.id, args: []interface{}{upper + "%"}, weight: 1.0},
+		}
+	case intentPostcode:
+		// Postcodes are stored with a single space between the two halves
+		if parts := postcodePattern.FindStringSubmatch(upper); parts != nil {
+			return intent, []searchStrategy{
+				{name: "postal", stmt: stmts.postal, args: []interface{}{parts[1] + " " + parts[2] + "%"}, weight: 1.0},
+			}
+		}
+		return intent, []searchStrategy{
+			{name: "postal", stmt: stmts.postal, args: []interface{}{upper + " %"}, weight: 1.0},
+		}
+	case intentCity:
+		return intent, []searchStrategy{
+			{name: "city", stmt: stmts.city, args: []interface{}{trimmed}, weight: 1.0},
+			nameStrategy(stmts, trimmed, 0.5),
+		}
+	default:
+		return intent, []searchStrategy{
+			nameStrategy(stmts, trimmed, 1.0),
+		}
+	}
+}
+
+// nameStrategy searches names with FULLTEXT prefix matching. The term is
+// bound twice, once for the relevance score and once for the filter.
+func nameStrategy(stmts searchStatements, query string, weight float64) searchStrategy {
+	term := query + "*"
+	return searchStrategy{name: "name", stmt: stmts.name, args: []interface{}{term, term}, weight: weight}
+}
+
+// nameTerms splits a query into lowercase words, dropping characters that
+// are operators in FULLTEXT boolean mode.
+func nameTerms(query string) []string {
+	return strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sort"
+)
+
+// Ways of combining the ranked results of several strategies
+const (
+	mergeRRF      = "rrf"
+	mergeWeighted = "weighted"
+)
+
+// rrfK dampens the advantage of the very top ranks in reciprocal-rank
+// fusion; 60 is the value used in the original RRF paper.
+const rrfK = 60
+
+// scoredCompany is a company as returned by one strategy, with the score
+// that strategy gave it.
+type scoredCompany struct {
+	Company
+	score float64
+}
+
+// mergeResults fuses the ranked results of each strategy into one list.
+//
+// With "rrf" a company scores weight / (rrfK + rank) for every strategy
+// that found it, so agreement between strategies and high ranks both count
+// while raw scores from different strategies never need comparing. With
+// "weighted" each strategy's scores are normalized to its best hit and the
+// weighted scores are summed.
+//
+// Ties are broken by company ID, so identical queries always return the
+// same order no matter which strategy finished first. Results derived from
+// a cached prefix are the exception: they keep the prefix's order.
+func mergeResults(method string, strategies []searchStrategy, results [][]scoredCompany) []Company {
+	scores := make(map[string]float64)
+	companies := make(map[string]Company)
+
+	for i, found := range results {
+		weight := strategies[i].weight
+
+		best := 0.0
+		for _, c := range found {
+			if c.score > best {
+				best = c.score
+			}
+		}
+
+		for rank, c := range found {
+			if _, seen := companies[c.ID]; !seen {
+				companies[c.ID] = c.Company
+			}
+			switch method {
+			case mergeWeighted:
+				if best > 0 {
+					scores[c.ID] += weight * c.score / best
+				}
+			default:
+				scores[c.ID] += weight / float64(rrfK+rank+1)
+			}
+		}
+	}
+
+	merged := make([]Company, 0, len(companies))
+	for id, c := range companies {
+		c.Score = scores[id]
+		merged = append(merged, c)
+	}
+
+	sort.Slice(merged, func(a, b int) bool {
+		if merged[a].Score != merged[b].Score {
+			return merged[a].Score > merged[b].Score
+		}
+		return merged[a].ID < merged[b].ID
+	})
+	return merged
+}
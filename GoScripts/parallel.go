@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// Outcomes reported for each strategy in the response
+const (
+	statusOK        = "ok"
+	statusTimeout   = "timeout"
+	statusCancelled = "cancelled"
+	statusError     = "error"
+)
+
+// strategyStatus tells the client how one strategy fared, so incomplete
+// results are never silent.
+type strategyStatus struct {
+	Strategy string `json:"strategy"`
+	Status   string `json:"status"`
+	Count    int    `json:"count"`
+	TimeMs   int64  `json:"time_ms"`
+	Error    string `json:"error,omitempty"`
+}
+
+type strategyOutcome struct {
+	index   int
+	results []scoredCompany
+	status  strategyStatus
+}
+
+// runStrategies executes the strategies in parallel. Each one gets its own
+// deadline, and the whole search stops waiting once ctx is done, either at
+// the search deadline or because the client went away. Whatever
+// finished by then is returned; the statuses say which strategies timed
+// out or failed, and partial is true if any of them did. Queries taking at
+// least slowQuery are logged, unless it is 0.
+func runStrategies(ctx context.Context, strategies []searchStrategy, strategyTimeout, dbLatency, slowQuery time.Duration) ([][]scoredCompany, []strategyStatus, bool) {
+	start := time.Now()
+
+	// Buffered so late goroutines never block after we stop listening
+	outcomes := make(chan strategyOutcome, len(strategies))
+
+	for i, strategy := range strategies {
+		go func(i int, strategy searchStrategy) {
+			strategyCtx, cancel := context.WithTimeout(ctx, strategyTimeout)
+			defer cancel()
+
+			queryStart := time.Now()
+			found, err := searchWithLatency(strategyCtx, strategy, dbLatency, slowQuery)
+			status := strategyStatus{
+				Strategy: strategy.name,
+				Status:   statusOK,
+				Count:    len(found),
+				TimeMs:   time.Since(queryStart).Milliseconds(),
+			}
+
+			switch {
+			case errors.Is(err, context.Canceled) || (err != nil && errors.Is(strategyCtx.Err(), context.Canceled)):
+				status.Status = statusCancelled
+				slog.DebugContext(ctx, "Strategy cancelled", "strategy", strategy.name, "time_ms", status.TimeMs)
+			case errors.Is(err, context.DeadlineExceeded) || (err != nil && strategyCtx.Err() != nil):
+				status.Status = statusTimeout
+				slog.WarnContext(ctx, "Strategy timed out", "strategy", strategy.name, "time_ms", status.TimeMs)
+			case err != nil:
+				status.Status = statusError
+				status.Error = err.Error()
+				slog.ErrorContext(ctx, "Strategy failed", "strategy", strategy.name, "error", err)
+			default:
+				slog.DebugContext(ctx, "Strategy finished", "strategy", strategy.name, "count", len(found), "time_ms", status.TimeMs)
+			}
+
+			outcomes <- strategyOutcome{index: i, results: found, status: status}
+		}(i, strategy)
+	}
+
+	results := make([][]scoredCompany, len(strategies))
+	statuses := make([]strategyStatus, len(strategies))
+	received := make([]bool, len(strategies))
+
+collect:
+	for collected := 0; collected < len(strategies); collected++ {
+		select {
+		case outcome := <-outcomes:
+			results[outcome.index] = outcome.results
+			statuses[outcome.index] = outcome.status
+			received[outcome.index] = true
+		case <-ctx.Done():
+			break collect
+		}
+	}
+
+	partial := false
+	for i, strategy := range strategies {
+		if !received[i] {
+			statuses[i] = strategyStatus{
+				Strategy: strategy.name,
+				Status:   statusTimeout,
+				TimeMs:   time.Since(start).Milliseconds(),
+			}
+			if errors.Is(ctx.Err(), context.Canceled) {
+				statuses[i].Status = statusCancelled
+			}
+			slog.WarnContext(ctx, "Strategy abandoned", "strategy", strategy.name, "error", ctx.Err())
+		}
+		if statuses[i].Status != statusOK {
+			partial = true
+		}
+	}
+
+	return results, statuses, partial
+}
+
+// searchWithLatency runs one strategy, first waiting out the simulated DB
+// latency unless the deadline arrives sooner.
+func searchWithLatency(ctx context.Context, strategy searchStrategy, dbLatency, slowQuery time.Duration) ([]scoredCompany, error) {
+	if dbLatency > 0 {
+		select {
+		case <-time.After(dbLatency):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	queryStart := time.Now()
+	found, err := queryCompanies(ctx, strategy.stmt, strategy.args)
+	elapsed := time.Since(queryStart)
+	if slowQuery > 0 && elapsed >= slowQuery {
+		slog.WarnContext(ctx, "Slow query",
+			"strategy", strategy.name,
+			"sql", strategy.stmt.sql,
+			argsAttr(strategy.args),
+			"duration_ms", elapsed.Milliseconds(),
+			"rows", len(found),
+		)
+	}
+	return found, err
+}
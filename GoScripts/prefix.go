@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"unicode/utf8"
+)
+
+// defaultStopwords is InnoDB's built-in stopword list, used when the
+// server's list can't be read.
+var defaultStopwords = []string{
+	"a", "about", "an", "are", "as", "at", "be", "by", "com", "de", "en",
+	"for", "from", "how", "i", "in", "is", "it", "la", "of", "on", "or",
+	"that", "the", "this", "to", "was", "what", "when", "where", "who",
+	"will", "with", "und", "www",
+}
+
+// fulltextRules describes the words MySQL leaves out of the FULLTEXT index:
+// those shorter than innodb_ft_min_token_size, and stopwords. A required
+// term that isn't indexed is ignored by the query rather than matched, so
+// nameMatches can't mirror it.
+type fulltextRules struct {
+	minTokenSize int
+	stopwords    map[string]bool
+}
+
+// indexed reports whether MySQL indexes the word, i.e. whether a required
+// term for it narrows the results.
+func (f fulltextRules) indexed(word string) bool {
+	return utf8.RuneCountInString(word) >= f.minTokenSize && !f.stopwords[word]
+}
+
+// loadFulltextRules reads the token size and stopword list from the server
+// at startup, falling back to the InnoDB defaults when they can't be read.
+func loadFulltextRules(db *sql.DB) fulltextRules {
+	rules := fulltextRules{minTokenSize: 3, stopwords: make(map[string]bool)}
+	if err := db.QueryRow("SELECT @@innodb_ft_min_token_size").Scan(&rules.minTokenSize); err != nil {
+		slog.Warn("Could not read innodb_ft_min_token_size, assuming 3", "error", err)
+		rules.minTokenSize = 3
+	}
+
+	stopwords, err := loadStopwords(db)
+	if err != nil {
+		slog.Warn("Could not read the FULLTEXT stopwords, assuming the InnoDB defaults", "error", err)
+		stopwords = defaultStopwords
+	}
+	for _, word := range stopwords {
+		rules.stopwords[strings.ToLower(word)] = true
+	}
+	return rules
+}
+
+// loadStopwords returns the stopwords InnoDB applies to new FULLTEXT
+// indexes: none when they are disabled, the server's own table when one is
+// configured and the built-in list otherwise.
+func loadStopwords(db *sql.DB) ([]string, error) {
+	var enabled bool
+	var table sql.NullString
+	if err := db.QueryRow("SELECT @@innodb_ft_enable_stopword, @@innodb_ft_server_stopword_table").Scan(&enabled, &table); err != nil {
+		return nil, err
+	}
+	if !enabled {
+		return nil, nil
+	}
+
+	query := "SELECT value FROM INFORMATION_SCHEMA.INNODB_FT_DEFAULT_STOPWORD"
+	if table.String != "" {
+		// The variable is "db_name/table_name"
+		schema, name, ok := strings.Cut(table.String, "/")
+		if !ok {
+			return nil, fmt.Errorf("unexpected stopword table %q", table.String)
+		}
+		query = fmt.Sprintf("SELECT value FROM `%s`.`%s`",
+			strings.ReplaceAll(schema, "`", "``"), strings.ReplaceAll(name, "`", "``"))
+	}
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stopwords []string
+	for rows.Next() {
+		var word string
+		if err := rows.Scan(&word); err != nil {
+			return nil, err
+		}
+		stopwords = append(stopwords, word)
+	}
+	return stopwords, rows.Err()
+}
+
+// deriveFromPrefix answers a query from the cached results of a shorter
+// prefix of it, so each keystroke of search-as-you-type doesn't have to go
+// to MySQL. A prefix can only be used when its cached result was complete,
+// i.e. under the result limit, it was routed the same way, and the query
+// only ever matches a subset of what the prefix matched, so filtering the
+// cached rows in memory gives the same set the database would return.
+//
+// It is the same set, not the same response: derived rows keep the order
+// and scores of the prefix they came from, since MySQL's relevance for the
+// longer query can't be worked out from them. Responses flag them as
+// derived, so clients know the ranking is the prefix's.
+func deriveFromPrefix(cache *Cache[cachedSearch], query string, intent string, cities cityIndex, fulltext fulltextRules, resultLimit int) ([]Company, string, bool) {
+	var match func(Company) bool
+	var refines func(prefix string) bool
+	switch intent {
+	case intentName:
+		terms, ok := plainTerms(query, fulltext)
+		if !ok {
+			return nil, "", false
+		}
+		match = func(c Company) bool { return nameMatches(c.Name, terms, fulltext) }
+		refines = func(prefix string) bool {
+			prefixTerms, ok := plainTerms(prefix, fulltext)
+			return ok && len(prefixTerms) == len(terms)
+		}
+	case intentCompanyNumber:
+		upper := strings.ToUpper(strings.TrimSpace(query))
+		match = func(c Company) bool { return strings.HasPrefix(c.ID, upper) }
+		refines = func(string) bool { return true }
+	default:
+		return nil, "", false
+	}
+
+	// Try the longest prefixes first, as they hold the fewest rows
+	for n := len(query) - 1; n >= 3; n-- {
+		prefix := query[:n]
+		if classifyIntent(prefix, cities) != intent || !refines(prefix) {
+			continue
+		}
+		cached, found := cache.Get(prefix)
+		if !found || cached.count >= resultLimit {
+			continue
+		}
+
+		derived := []Company{}
+		for _, c := range cached.results {
+			if match(c) {
+				derived = append(derived, c)
+			}
+		}
+		return derived, prefix, true
+	}
+	return nil, "", false
+}
+
+// plainTerms returns the words of a name query when nameMatches can mirror
+// the FULLTEXT search nameStrategy runs for it, "acme hold*", which matches
+// names with any of the words, the last as a prefix. Extending the last
+// word only narrows that, so a prefix with the same number of words can be
+// filtered; starting a new word widens it. Queries with boolean operators,
+// or with words MySQL doesn't index and so ignores, are left to the
+// database.
+func plainTerms(query string, fulltext fulltextRules) ([]string, bool) {
+	trimmed := strings.ToLower(strings.TrimSpace(query))
+	terms := nameTerms(trimmed)
+	if len(terms) == 0 || strings.Join(terms, " ") != strings.Join(strings.Fields(trimmed), " ") {
+		return nil, false
+	}
+	for _, term := range terms {
+		if !fulltext.indexed(term) {
+			return nil, false
+		}
+	}
+	return terms, true
+}
+
+// nameMatches mirrors the FULLTEXT query nameStrategy builds: a name
+// matches when one of its words is one of the terms but the last, or starts
+// with the last. Only the name's indexed words count, as only those are in
+// the FULLTEXT index.
+func nameMatches(name string, terms []string, fulltext fulltextRules) bool {
+	last := len(terms) - 1
+	for _, word := range nameTerms(name) {
+		if !fulltext.indexed(word) {
+			continue
+		}
+		if strings.HasPrefix(word, terms[last]) {
+			return true
+		}
+		for _, term := range terms[:last] {
+			if word == term {
+				return true
+			}
+		}
+	}
+	return false
+}
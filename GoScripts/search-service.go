@@ -2,14 +2,16 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"runtime"
-	"sync"
+	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -29,59 +31,47 @@ type Company struct {
 	Employees      int     `json:"employees"`
 	IncorporatedOn string  `json:"incorporated_on"`
 	LastFiledOn    string  `json:"last_filed_on"`
+	Score          float64 `json:"score"`
 }
 
-// Simple cache implementation
-type Cache struct {
-	items map[string]cacheItem
-	mutex sync.RWMutex
+// cachedSearch is what the cache holds for each query.
+type cachedSearch struct {
+	results     []Company
+	count       int
+	timeMs      int64
+	derivedFrom string // the cached prefix the results were derived from, if any
 }
 
-type cacheItem struct {
-	data       []Company
-	count      int
-	timeMs     int64
-	expiration time.Time
-}
-
-func NewCache() *Cache {
-	return &Cache{
-		items: make(map[string]cacheItem),
-	}
-}
-
-func (c *Cache) Set(key string, data []Company, count int, timeMs int64, duration time.Duration) {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	c.items[key] = cacheItem{
-		data:       data,
-		count:      count,
-		timeMs:     timeMs,
-		expiration: time.Now().Add(duration),
-	}
-}
-
-func (c *Cache) Get(key string) ([]Company, int, int64, bool) {
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
-	item, found := c.items[key]
-	if !found {
-		return nil, 0, 0, false
-	}
-	if time.Now().After(item.expiration) {
-		delete(c.items, key)
-		return nil, 0, 0, false
+// estimateSearchSize approximates the memory a cached search holds, for the
+// cache's byte budget.
+func estimateSearchSize(key string, search cachedSearch) int {
+	size := len(key) + len(search.derivedFrom) + 64
+	for _, c := range search.results {
+		size += 160 + len(c.ID) + len(c.Name) + len(c.Status) + len(c.AddressLine1) +
+			len(c.AddressLine2) + len(c.City) + len(c.Region) + len(c.PostalCode) +
+			len(c.Country) + len(c.IncorporatedOn) + len(c.LastFiledOn)
 	}
-	return item.data, item.count, item.timeMs, true
+	return size
 }
 
 func main() {
 	// Simulation configuration - hardcoded values
 	// Change these values to simulate different environments
-	cpuCores := 1      // $5 VPS typically has 1 core
-	maxConns := 10     // Limit DB connections
-	dbLatency := 5     // Add artificial DB latency in ms
-	resultLimit := 1000 // Maximum number of results to return
+	cpuCores := 1                                   // $5 VPS typically has 1 core
+	maxConns := 10                                  // Limit DB connections
+	dbLatency := 5                                  // Add artificial DB latency in ms
+	resultLimit := 1000                             // Maximum number of results to return
+	mergeMethod := getEnv("MERGE_METHOD", mergeRRF) // "rrf" or "weighted"
+	strategyTimeout := time.Duration(getEnvInt("STRATEGY_TIMEOUT_MS", 2000)) * time.Millisecond
+	searchTimeout := time.Duration(getEnvInt("SEARCH_TIMEOUT_MS", 3000)) * time.Millisecond
+	maxExecutionTime := getEnvInt("MAX_EXECUTION_TIME_MS", 3000)                 // MySQL kills SELECTs running longer than this
+	cacheMaxBytes := getEnvInt("CACHE_MAX_BYTES", 64<<20)                        // Memory budget for cached results
+	slowQuery := time.Duration(getEnvInt("SLOW_QUERY_MS", 0)) * time.Millisecond // 0 turns the slow query log off
+
+	// Leveled logging; LOG_REDACT_QUERIES keeps search text out of the logs
+	if err := setupLogging(getEnv("LOG_LEVEL", "info"), getEnv("LOG_FORMAT", "text"), getEnv("LOG_REDACT_QUERIES", "false") == "true"); err != nil {
+		fatal("Invalid logging configuration", "error", err)
+	}
 
 	// Set CPU cores
 	runtime.GOMAXPROCS(cpuCores)
@@ -92,12 +82,19 @@ func main() {
 	fmt.Printf("Max DB Connections: %d\n", maxConns)
 	fmt.Printf("Simulated DB Latency: %dms\n", dbLatency)
 	fmt.Printf("Result Limit: %d\n", resultLimit)
+	fmt.Printf("Merge Method: %s\n", mergeMethod)
+	fmt.Printf("Strategy Timeout: %s\n", strategyTimeout)
+	fmt.Printf("Search Timeout: %s\n", searchTimeout)
+	fmt.Printf("MySQL Max Execution Time: %dms\n", maxExecutionTime)
+	fmt.Printf("Cache Budget: %d bytes\n", cacheMaxBytes)
+	fmt.Printf("Slow Query Threshold: %s\n", slowQuery)
 	fmt.Printf("Go Version: %s\n", runtime.Version())
 	fmt.Printf("OS/Arch: %s/%s\n", runtime.GOOS, runtime.GOARCH)
 	fmt.Println("=====================================")
 
 	// Create cache with 5-minute expiration
-	cache := NewCache()
+	cache := NewCache(cacheMaxBytes, time.Minute, estimateSearchSize)
+	defer cache.Close()
 
 	// Database connection
 	dbUser := getEnv("DB_USERNAME", "root")
@@ -106,10 +103,12 @@ func main() {
 	dbPort := getEnv("DB_PORT", "3306")
 	dbName := getEnv("DB_DATABASE", "lightning_search")
 
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true", dbUser, dbPass, dbHost, dbPort, dbName)
+	// max_execution_time is set on every connection, so MySQL itself stops
+	// runaway searches even if the service has already given up on them
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true&max_execution_time=%d", dbUser, dbPass, dbHost, dbPort, dbName, maxExecutionTime)
 	db, err := sql.Open("mysql", dsn)
 	if err != nil {
-		log.Fatal(err)
+		fatal("Failed to open database", "error", err)
 	}
 	defer db.Close()
 
@@ -120,79 +119,91 @@ func main() {
 
 	// Test connection
 	if err := db.Ping(); err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+		fatal("Failed to connect to database", "error", err)
 	}
 
 	// Create prepared statements for different search types with dynamic limit
-	nameStmt, err := db.Prepare(fmt.Sprintf(`
+	nameStmt, err := prepareStatement(db, fmt.Sprintf(`
 		SELECT
 			company_id, name, status, address_line_1, address_line_2,
 			city, region, postal_code, country, revenue,
-			employees, incorporated_on, last_filed_on
+			employees, incorporated_on, last_filed_on,
+			MATCH(name) AGAINST(? IN BOOLEAN MODE) AS relevance
 		FROM search
 		WHERE MATCH(name) AGAINST(? IN BOOLEAN MODE)
+		ORDER BY relevance DESC, company_id
 		LIMIT %d
 	`, resultLimit))
 	if err != nil {
-		log.Fatalf("Failed to prepare name statement: %v", err)
+		fatal("Failed to prepare name statement", "error", err)
 	}
 	defer nameStmt.Close()
 
-	idStmt, err := db.Prepare(fmt.Sprintf(`
+	idStmt, err := prepareStatement(db, fmt.Sprintf(`
 		SELECT
 			company_id, name, status, address_line_1, address_line_2,
 			city, region, postal_code, country, revenue,
-			employees, incorporated_on, last_filed_on
+			employees, incorporated_on, last_filed_on,
+			1 AS relevance
 		FROM search
 		WHERE company_id LIKE ?
+		ORDER BY company_id
 		LIMIT %d
 	`, resultLimit))
 	if err != nil {
-		log.Fatalf("Failed to prepare id statement: %v", err)
+		fatal("Failed to prepare id statement", "error", err)
 	}
 	defer idStmt.Close()
 
-	cityStmt, err := db.Prepare(fmt.Sprintf(`
+	cityStmt, err := prepareStatement(db, fmt.Sprintf(`
 		SELECT
 			company_id, name, status, address_line_1, address_line_2,
 			city, region, postal_code, country, revenue,
-			employees, incorporated_on, last_filed_on
+			employees, incorporated_on, last_filed_on,
+			1 AS relevance
 		FROM search
-		WHERE city LIKE ?
+		WHERE city = ?
+		ORDER BY id
 		LIMIT %d
 	`, resultLimit))
 	if err != nil {
-		log.Fatalf("Failed to prepare city statement: %v", err)
+		fatal("Failed to prepare city statement", "error", err)
 	}
 	defer cityStmt.Close()
 
-	postalStmt, err := db.Prepare(fmt.Sprintf(`
+	postalStmt, err := prepareStatement(db, fmt.Sprintf(`
 		SELECT
 			company_id, name, status, address_line_1, address_line_2,
 			city, region, postal_code, country, revenue,
-			employees, incorporated_on, last_filed_on
+			employees, incorporated_on, last_filed_on,
+			1 AS relevance
 		FROM search
 		WHERE postal_code LIKE ?
+		ORDER BY postal_code, company_id
 		LIMIT %d
 	`, resultLimit))
 	if err != nil {
-		log.Fatalf("Failed to prepare postal statement: %v", err)
+		fatal("Failed to prepare postal statement", "error", err)
 	}
 	defer postalStmt.Close()
 
+	stmts := searchStatements{
+		name:   nameStmt,
+		id:     idStmt,
+		city:   cityStmt,
+		postal: postalStmt,
+	}
+
+	// Load known city names for query routing
+	cities := loadCityIndex(db, 50000)
+	fmt.Printf("Known cities: %d\n", len(cities))
+
+	// Words MySQL doesn't index, which prefix derivation can't filter on
+	fulltext := loadFulltextRules(db)
+	fmt.Printf("FULLTEXT Min Token Size: %d\n", fulltext.minTokenSize)
+
 	// Define HTTP handler for search
 	http.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
-		// Set CORS headers for all responses
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
-		// Handle preflight requests
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-
 		startTime := time.Now()
 
 		// Get query parameter
@@ -207,15 +218,41 @@ func main() {
 			return
 		}
 
-		// Check cache first
-		if results, count, timeMs, found := cache.Get(query); found {
-			log.Printf("Cache hit for query: %s (found %d results in %dms)", query, count, timeMs)
+		// Route the query to the strategies that fit it
+		intent, strategies := classifyQuery(query, stmts, cities)
+
+		// Check cache first, then try to derive the results from a cached
+		// shorter prefix of the query
+		cached, found := cache.Get(query)
+		if !found {
+			if derived, prefix, ok := deriveFromPrefix(cache, query, intent, cities, fulltext, resultLimit); ok {
+				cached = cachedSearch{
+					results:     derived,
+					count:       len(derived),
+					timeMs:      time.Since(startTime).Milliseconds(),
+					derivedFrom: prefix,
+				}
+				cache.Set(query, cached, 5*time.Minute)
+				found = true
+			}
+		}
+		if found {
+			results, count, timeMs, derivedFrom := cached.results, cached.count, cached.timeMs, cached.derivedFrom
+			if derivedFrom != "" {
+				slog.InfoContext(r.Context(), "Derived hit", queryAttr("query", query), queryAttr("prefix", derivedFrom), "count", count)
+			} else {
+				slog.InfoContext(r.Context(), "Cache hit", queryAttr("query", query), "count", count, "time_ms", timeMs)
+			}
 			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(map[string]interface{}{
-				"results": results,
-				"time_ms": timeMs,
-				"count":   count,
-				"cached":  true,
+				"results":      results,
+				"time_ms":      timeMs,
+				"count":        count,
+				"cached":       true,
+				"derived":      derivedFrom != "",
+				"derived_from": derivedFrom,
+				"intent":       intent,
+				"partial":      false,
 				"server_info": map[string]interface{}{
 					"cpu_cores":    cpuCores,
 					"max_db_conns": maxConns,
@@ -228,117 +265,29 @@ func main() {
 			return
 		}
 
-		log.Printf("Search query: %s", query)
+		slog.InfoContext(r.Context(), "Search query", queryAttr("query", query), "intent", intent, "strategies", len(strategies))
 
 		// Simulate DB latency for a cheap VPS
 		if dbLatency > 0 {
 			time.Sleep(time.Duration(dbLatency) * time.Millisecond)
 		}
 
-		// Prepare search terms
-		nameSearchTerm := query + "*" // For FULLTEXT search
-		likeSearchTerm := query + "%" // For LIKE search (better performance than %query%)
-
-		// Execute parallel searches
-		var wg sync.WaitGroup
-		var mutex sync.Mutex
-		var results []Company
-
-		// Search by name (FULLTEXT)
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-
-			// Simulate DB latency for a cheap VPS
-			if dbLatency > 0 {
-				time.Sleep(time.Duration(dbLatency) * time.Millisecond)
-			}
-
-			queryStart := time.Now()
-			rows, err := nameStmt.Query(nameSearchTerm)
-			if err != nil {
-				log.Printf("Name search error: %v", err)
-				return
-			}
-			defer rows.Close()
-
-			var nameResults []Company
-			for rows.Next() {
-				var c Company
-				err := rows.Scan(
-					&c.ID, &c.Name, &c.Status, &c.AddressLine1, &c.AddressLine2,
-					&c.City, &c.Region, &c.PostalCode, &c.Country, &c.Revenue,
-					&c.Employees, &c.IncorporatedOn, &c.LastFiledOn,
-				)
-				if err != nil {
-					log.Printf("Row scan error: %v", err)
-					continue
-				}
-				nameResults = append(nameResults, c)
-			}
-
-			queryTime := time.Since(queryStart).Milliseconds()
-			log.Printf("Name search found %d results in %dms", len(nameResults), queryTime)
-
-			mutex.Lock()
-			results = append(results, nameResults...)
-			mutex.Unlock()
-		}()
+		// Execute the routed strategies in parallel, each with its own
+		// deadline and the whole search bounded by the search timeout.
+		// Tying it to the request cancels the queries when the client
+		// drops the connection, e.g. when the user keeps typing.
+		searchCtx, cancel := context.WithTimeout(r.Context(), searchTimeout)
+		defer cancel()
+		strategyResults, statuses, partial := runStrategies(searchCtx, strategies, strategyTimeout, time.Duration(dbLatency)*time.Millisecond, slowQuery)
 
-		// Search by ID
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-
-			// Simulate DB latency for a cheap VPS
-			if dbLatency > 0 {
-				time.Sleep(time.Duration(dbLatency) * time.Millisecond)
-			}
-
-			queryStart := time.Now()
-			rows, err := idStmt.Query(likeSearchTerm)
-			if err != nil {
-				log.Printf("ID search error: %v", err)
-				return
-			}
-			defer rows.Close()
-
-			var idResults []Company
-			for rows.Next() {
-				var c Company
-				err := rows.Scan(
-					&c.ID, &c.Name, &c.Status, &c.AddressLine1, &c.AddressLine2,
-					&c.City, &c.Region, &c.PostalCode, &c.Country, &c.Revenue,
-					&c.Employees, &c.IncorporatedOn, &c.LastFiledOn,
-				)
-				if err != nil {
-					log.Printf("Row scan error: %v", err)
-					continue
-				}
-				idResults = append(idResults, c)
-			}
-
-			queryTime := time.Since(queryStart).Milliseconds()
-			log.Printf("ID search found %d results in %dms", len(idResults), queryTime)
-
-			mutex.Lock()
-			results = append(results, idResults...)
-			mutex.Unlock()
-		}()
-
-		// Wait for all searches to complete
-		wg.Wait()
-
-		// Deduplicate results based on ID
-		seen := make(map[string]bool)
-		uniqueResults := []Company{}
-		for _, company := range results {
-			if !seen[company.ID] {
-				seen[company.ID] = true
-				uniqueResults = append(uniqueResults, company)
-			}
+		if r.Context().Err() != nil {
+			slog.InfoContext(r.Context(), "Search cancelled by client", queryAttr("query", query))
+			return
 		}
 
+		// Merge and deduplicate results by rank
+		uniqueResults := mergeResults(mergeMethod, strategies, strategyResults)
+
 		// Limit to configured result limit
 		if len(uniqueResults) > resultLimit {
 			uniqueResults = uniqueResults[:resultLimit]
@@ -347,18 +296,27 @@ func main() {
 		// Calculate query time
 		elapsed := time.Since(startTime).Milliseconds()
 
-		log.Printf("Total: Found %d unique results in %dms", len(uniqueResults), elapsed)
+		slog.InfoContext(r.Context(), "Search finished", "count", len(uniqueResults), "time_ms", elapsed, "partial", partial)
 
-		// Cache the results
-		cache.Set(query, uniqueResults, len(uniqueResults), elapsed, 5*time.Minute)
+		// Cache the results, unless some strategies didn't finish
+		if !partial {
+			cache.Set(query, cachedSearch{
+				results: uniqueResults,
+				count:   len(uniqueResults),
+				timeMs:  elapsed,
+			}, 5*time.Minute)
+		}
 
 		// Return JSON response
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
-			"results": uniqueResults,
-			"time_ms": elapsed,
-			"count":   len(uniqueResults),
-			"cached":  false,
+			"results":    uniqueResults,
+			"time_ms":    elapsed,
+			"count":      len(uniqueResults),
+			"cached":     false,
+			"intent":     intent,
+			"partial":    partial,
+			"strategies": statuses,
 			"server_info": map[string]interface{}{
 				"cpu_cores":    cpuCores,
 				"max_db_conns": maxConns,
@@ -372,11 +330,11 @@ func main() {
 
 	// Add a simple ping endpoint for testing
 	http.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"status": "ok",
 			"time":   time.Now().String(),
+			"cache":  cache.Stats(),
 			"server_info": map[string]interface{}{
 				"cpu_cores":    cpuCores,
 				"max_db_conns": maxConns,
@@ -388,10 +346,43 @@ func main() {
 		})
 	})
 
+	// Apply the CORS policy to every endpoint
+	cors, err := loadCORSPolicy()
+	if err != nil {
+		fatal("Invalid CORS configuration", "error", err)
+	}
+	fmt.Printf("CORS Allowed Origins: %s\n", strings.Join(cors.Origins, ", "))
+
 	// Start server
 	port := getEnv("PORT", "3001")
 	fmt.Printf("Search service listening on port %s...\n", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	fatal("Server stopped", "error", http.ListenAndServe(":"+port, withRequestIDs(cors.Wrap(http.DefaultServeMux))))
+}
+
+// queryCompanies runs a prepared search statement and scans the companies
+// it returns, in the statement's rank order, with their sub-query score.
+func queryCompanies(ctx context.Context, stmt statement, args []interface{}) ([]scoredCompany, error) {
+	rows, err := stmt.QueryContext(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var companies []scoredCompany
+	for rows.Next() {
+		var c scoredCompany
+		err := rows.Scan(
+			&c.ID, &c.Name, &c.Status, &c.AddressLine1, &c.AddressLine2,
+			&c.City, &c.Region, &c.PostalCode, &c.Country, &c.Revenue,
+			&c.Employees, &c.IncorporatedOn, &c.LastFiledOn, &c.score,
+		)
+		if err != nil {
+			slog.WarnContext(ctx, "Row scan error", "error", err)
+			continue
+		}
+		companies = append(companies, c)
+	}
+	return companies, rows.Err()
 }
 
 func getEnv(key, fallback string) string {
@@ -400,3 +391,27 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+func getEnvInt(key string, fallback int) int {
+	if value, exists := os.LookupEnv(key); exists {
+		if i, err := strconv.Atoi(value); err == nil {
+			return i
+		}
+	}
+	return fallback
+}
+
+// getEnvList reads a comma-separated list.
+func getEnvList(key string, fallback []string) []string {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -12,6 +12,62 @@
         'host' => env('LIGHTNING_SEARCH_HOST', '127.0.0.1'),
         'port' => env('LIGHTNING_SEARCH_PORT', 8081),
         'timeout' => env('LIGHTNING_SEARCH_TIMEOUT', 5), // seconds
+        'strategy' => env('LIGHTNING_SEARCH_STRATEGY', 'auto'), // 'auto', 'fulltext' or 'like'
+        'key' => env('LIGHTNING_SEARCH_KEY'), // sent as a bearer token on every request
+        'signing_secret' => env('LIGHTNING_SEARCH_SIGNING_SECRET'), // HMAC-signs every request when set
+        'claims_secret' => env('LIGHTNING_SEARCH_CLAIMS_SECRET'), // signs tenant and constraint claims, defaults to signing_secret
+        'scheme' => env('LIGHTNING_SEARCH_SCHEME', 'http'), // 'https' when the service has TLS enabled
+    ],
+
+    // Browser origins allowed to call the Go service directly. Origins may
+    // use * as a wildcard, e.g. 'https://*.example.com'. Exported to the
+    // service by lightning-search:start.
+    'cors' => [
+        'allowed_origins' => ['*'],
+        'allowed_methods' => ['GET', 'POST', 'DELETE'],
+        'allowed_headers' => ['Content-Type', 'Authorization', 'X-Search-Priority'],
+        'exposed_headers' => ['RateLimit-Limit', 'RateLimit-Remaining', 'RateLimit-Reset', 'RateLimit-Policy', 'Retry-After', 'X-Request-ID'],
+        'supports_credentials' => false, // requires explicit allowed_origins, not '*'
+        'max_age' => 600, // seconds browsers may cache a preflight response
+    ],
+
+    // TLS for the Go service. The server settings are read by the service;
+    // the client settings are used by the package when calling it.
+    'tls' => [
+        'cert' => env('LIGHTNING_SEARCH_TLS_CERT'),
+        'key' => env('LIGHTNING_SEARCH_TLS_KEY'),
+        'min_version' => env('LIGHTNING_SEARCH_TLS_MIN_VERSION', '1.2'), // '1.2' or '1.3'
+        'ciphers' => env('LIGHTNING_SEARCH_TLS_CIPHERS', 'modern'), // 'modern' or 'compatible'
+        'client_ca' => env('LIGHTNING_SEARCH_TLS_CLIENT_CA'), // enables mutual TLS
+        'client_auth' => env('LIGHTNING_SEARCH_TLS_CLIENT_AUTH', 'require'), // 'require' or 'optional'
+
+        'client' => [
+            'ca' => env('LIGHTNING_SEARCH_CLIENT_CA'), // CA to verify the service with
+            'cert' => env('LIGHTNING_SEARCH_CLIENT_CERT'), // certificate for mutual TLS
+            'key' => env('LIGHTNING_SEARCH_CLIENT_KEY'),
+        ],
+    ],
+
+    // API keys the Go service accepts. With none configured the service
+    // accepts any request. Exported to the service by lightning-search:start.
+    'auth' => [
+        'keys' => [
+            [
+                'name' => 'app',
+                'key' => env('LIGHTNING_SEARCH_KEY'),
+                'tables' => ['*'], // or e.g. ['companies', 'users']
+                'operations' => ['search', 'admin'],
+                'rate_limit' => 0, // requests per minute per route, 0 uses the route limits below
+                'tenant' => null, // binds the key to one tenant, which rules out the admin operation
+            ],
+        ],
+
+        // Requests per minute per client (API key, or IP without keys), 0 for unlimited
+        'rate_limits' => [
+            'search' => env('LIGHTNING_SEARCH_RATE_LIMIT_SEARCH', 0),
+            'admin' => env('LIGHTNING_SEARCH_RATE_LIMIT_ADMIN', 0),
+            'auth_failures' => env('LIGHTNING_SEARCH_RATE_LIMIT_AUTH_FAILURES', 30), // failed key checks per IP
+        ],
     ],
 
     // Database configuration (will use Laravel's database config by default)
@@ -29,7 +85,28 @@
         'cpu_cores' => env('LIGHTNING_SEARCH_CPU_CORES', 1),
         'max_connections' => env('LIGHTNING_SEARCH_MAX_CONNECTIONS', 10),
         'cache_duration' => env('LIGHTNING_SEARCH_CACHE_DURATION', 300), // seconds
+        'cache_max_bytes' => env('LIGHTNING_SEARCH_CACHE_MAX_BYTES', 67108864), // 64MB
+        'cache_janitor_interval' => env('LIGHTNING_SEARCH_CACHE_JANITOR_INTERVAL', 60), // seconds
+        'cache_stale_grace' => env('LIGHTNING_SEARCH_CACHE_STALE_GRACE', 60), // seconds
+        'cache_driver' => env('LIGHTNING_SEARCH_CACHE_DRIVER', 'local'), // local or redis
+        'redis_url' => env('LIGHTNING_SEARCH_REDIS_URL', 'redis://127.0.0.1:6379/0'),
+        'redis_prefix' => env('LIGHTNING_SEARCH_REDIS_PREFIX', 'lightning-search:'),
+        'redis_timeout' => env('LIGHTNING_SEARCH_REDIS_TIMEOUT', 250), // milliseconds
+        'cache_snapshot_interval' => env('LIGHTNING_SEARCH_CACHE_SNAPSHOT_INTERVAL', 60), // seconds, 0 disables
+        'warmup_keys' => env('LIGHTNING_SEARCH_WARMUP_KEYS', 500),
+        'warmup_concurrency' => env('LIGHTNING_SEARCH_WARMUP_CONCURRENCY', 4),
+        'warmup_timeout' => env('LIGHTNING_SEARCH_WARMUP_TIMEOUT', 30), // seconds
+        'max_concurrent' => env('LIGHTNING_SEARCH_MAX_CONCURRENT', 0), // 0 is two per CPU core
+        'batch_concurrent' => env('LIGHTNING_SEARCH_BATCH_CONCURRENT', 0), // 0 is half of max_concurrent
+        'queue_size' => env('LIGHTNING_SEARCH_QUEUE_SIZE', 100),
+        'queue_timeout' => env('LIGHTNING_SEARCH_QUEUE_TIMEOUT', 1000), // milliseconds
         'result_limit' => env('LIGHTNING_SEARCH_RESULT_LIMIT', 1000),
+        'max_execution_time' => env('LIGHTNING_SEARCH_MAX_EXECUTION_TIME', 5000), // milliseconds
+        'metrics_addr' => env('LIGHTNING_SEARCH_METRICS_ADDR'), // e.g. 127.0.0.1:9100, serves /metrics there instead
+        'log_level' => env('LIGHTNING_SEARCH_LOG_LEVEL', 'info'), // debug, info, warn or error
+        'log_format' => env('LIGHTNING_SEARCH_LOG_FORMAT', 'text'), // or json
+        'slow_query_ms' => env('LIGHTNING_SEARCH_SLOW_QUERY_MS', 0), // 0 turns the slow query log off
+        'log_redact_queries' => env('LIGHTNING_SEARCH_LOG_REDACT_QUERIES', false),
     ],
 
     // Searchable models configuration
@@ -39,6 +116,9 @@
         //     'searchable_fields' => ['name', 'email'],
         //     'index_fields' => ['id', 'name', 'email', 'created_at'],
         //     'table' => 'users', // optional, will be inferred from model
+        //     'tenant_column' => 'tenant_id', // optional, restricts searches to the current tenant
+        //     'constraint_columns' => ['region'], // optional, columns searches can be constrained on
+        //     'soft_delete_column' => 'deleted_at', // optional, detected for SoftDeletes models
         // ],
     ],
 
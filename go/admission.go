@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Lanes searches are admitted through. Interactive searches are served
+// before queued batch searches whenever a slot frees up.
+type lane int
+
+const (
+	laneInteractive lane = iota
+	laneBatch
+)
+
+func (l lane) String() string {
+	if l == laneBatch {
+		return "batch"
+	}
+	return "interactive"
+}
+
+// requestLane reads the lane from the X-Search-Priority header; anything
+// other than "batch" is interactive.
+func requestLane(r *http.Request) lane {
+	if r.Header.Get("X-Search-Priority") == "batch" {
+		return laneBatch
+	}
+	return laneInteractive
+}
+
+var (
+	errQueueFull    = errors.New("search queue is full")
+	errQueueTimeout = errors.New("timed out waiting for a search slot")
+)
+
+// isOverloaded reports whether err means the governor turned a search away.
+func isOverloaded(err error) bool {
+	return errors.Is(err, errQueueFull) || errors.Is(err, errQueueTimeout)
+}
+
+// Governor limits how many searches hit the database at once. Searches
+// over the limit wait in a bounded queue per lane for up to a timeout and
+// are rejected once the queue is full, so a burst degrades into fast 429s
+// instead of every search slowing down together.
+//
+// Batch searches may only ever hold batchLimit slots, which keeps the
+// rest free for interactive traffic.
+type Governor struct {
+	limit      int
+	batchLimit int
+	queueSize  int
+	timeout    time.Duration
+
+	mutex  sync.Mutex
+	active [2]int
+	queues [2][]*admissionWaiter
+
+	admitted [2]atomic.Int64
+	rejected [2]atomic.Int64
+	timedOut [2]atomic.Int64
+}
+
+type admissionWaiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// AdmissionStats is a point-in-time view of one lane.
+type AdmissionStats struct {
+	Active   int   `json:"active"`
+	Queued   int   `json:"queued"`
+	Admitted int64 `json:"admitted"`
+	Rejected int64 `json:"rejected"`
+	TimedOut int64 `json:"timed_out"`
+}
+
+func NewGovernor(limit, batchLimit, queueSize int, timeout time.Duration) *Governor {
+	if limit < 1 {
+		limit = 1
+	}
+	if batchLimit < 1 {
+		batchLimit = (limit + 1) / 2
+	}
+	if batchLimit > limit {
+		batchLimit = limit
+	}
+	return &Governor{
+		limit:      limit,
+		batchLimit: batchLimit,
+		queueSize:  queueSize,
+		timeout:    timeout,
+	}
+}
+
+// canRun reports whether a search in lane l could start now; the caller
+// must hold the lock.
+func (g *Governor) canRun(l lane) bool {
+	if g.active[laneInteractive]+g.active[laneBatch] >= g.limit {
+		return false
+	}
+	return l == laneInteractive || g.active[laneBatch] < g.batchLimit
+}
+
+// Acquire waits for a slot in lane l and returns the function that gives
+// it back. It fails with errQueueFull, errQueueTimeout or ctx's error.
+func (g *Governor) Acquire(ctx context.Context, l lane) (func(), error) {
+	g.mutex.Lock()
+	if len(g.queues[l]) == 0 && g.canRun(l) {
+		g.active[l]++
+		g.mutex.Unlock()
+		g.admitted[l].Add(1)
+		return g.releaser(l), nil
+	}
+	if len(g.queues[l]) >= g.queueSize {
+		g.mutex.Unlock()
+		g.rejected[l].Add(1)
+		return nil, errQueueFull
+	}
+	waiter := &admissionWaiter{ready: make(chan struct{})}
+	g.queues[l] = append(g.queues[l], waiter)
+	g.mutex.Unlock()
+
+	timer := time.NewTimer(g.timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-waiter.ready:
+		g.admitted[l].Add(1)
+		return g.releaser(l), nil
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	g.mutex.Lock()
+	if waiter.granted {
+		// The slot was handed over just as we gave up; pass it on
+		g.mutex.Unlock()
+		g.releaser(l)()
+		return nil, err
+	}
+	for i, w := range g.queues[l] {
+		if w == waiter {
+			g.queues[l] = append(g.queues[l][:i], g.queues[l][i+1:]...)
+			break
+		}
+	}
+	g.mutex.Unlock()
+	if err == errQueueTimeout {
+		g.timedOut[l].Add(1)
+	}
+	return nil, err
+}
+
+func (g *Governor) releaser(l lane) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			g.mutex.Lock()
+			defer g.mutex.Unlock()
+			g.active[l]--
+			g.dispatch()
+		})
+	}
+}
+
+// dispatch hands free slots to waiting searches, interactive first; the
+// caller must hold the lock.
+func (g *Governor) dispatch() {
+	for _, next := range []lane{laneInteractive, laneBatch} {
+		for len(g.queues[next]) > 0 && g.canRun(next) {
+			waiter := g.queues[next][0]
+			g.queues[next] = g.queues[next][1:]
+			g.active[next]++
+			waiter.granted = true
+			close(waiter.ready)
+		}
+	}
+}
+
+// RetryAfter is how long a rejected client should wait, in whole seconds.
+func (g *Governor) RetryAfter() int {
+	seconds := int(g.timeout.Round(time.Second) / time.Second)
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
+
+func (g *Governor) Stats() map[string]AdmissionStats {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	stats := make(map[string]AdmissionStats, 2)
+	for _, l := range []lane{laneInteractive, laneBatch} {
+		stats[l.String()] = AdmissionStats{
+			Active:   g.active[l],
+			Queued:   len(g.queues[l]),
+			Admitted: g.admitted[l].Load(),
+			Rejected: g.rejected[l].Load(),
+			TimedOut: g.timedOut[l].Load(),
+		}
+	}
+	return stats
+}
+
+// handleAdmissionStats serves GET /admission/stats.
+func handleAdmissionStats(governor *Governor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(governor.Stats())
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Operations an API key can be allowed to perform.
+const (
+	opSearch = "search"
+	opAdmin  = "admin"
+)
+
+// APIKey is a credential sent as `Authorization: Bearer <key>`. Tables and
+// Operations list what it may touch; "*" in Tables allows every table.
+// A key with a Tenant only ever sees that tenant's rows, and can't use the
+// admin endpoints, whose rules and cache entries span every tenant.
+// RateLimit replaces the per-route rate limits for the key, in requests
+// per minute per route, with 0 keeping the route defaults.
+type APIKey struct {
+	Name       string   `json:"name"`
+	Key        string   `json:"key"`
+	Tables     []string `json:"tables"`
+	Operations []string `json:"operations"`
+	RateLimit  int      `json:"rate_limit"`
+	Tenant     string   `json:"tenant"`
+}
+
+// AllowsTable reports whether the key may search table. A nil key, which
+// is what requests carry when authentication is off, allows everything.
+func (k *APIKey) AllowsTable(table string) bool {
+	if k == nil {
+		return true
+	}
+	for _, allowed := range k.Tables {
+		if allowed == "*" || allowed == table {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsOperation reports whether the key may perform op.
+func (k *APIKey) AllowsOperation(op string) bool {
+	if k == nil {
+		return true
+	}
+	if op == opAdmin && k.Tenant != "" {
+		return false
+	}
+	for _, allowed := range k.Operations {
+		if allowed == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *APIKey) validate() error {
+	if k.Name == "" {
+		return fmt.Errorf("every key needs a name")
+	}
+	if k.Key == "" {
+		return fmt.Errorf("key %q has no secret", k.Name)
+	}
+	for _, op := range k.Operations {
+		if op != opSearch && op != opAdmin {
+			return fmt.Errorf("key %q has unknown operation %q", k.Name, op)
+		}
+		if op == opAdmin && k.Tenant != "" {
+			return fmt.Errorf("key %q is bound to a tenant and can't be given the admin operation", k.Name)
+		}
+	}
+	return nil
+}
+
+// Authenticator checks API keys. Keys are indexed by their SHA-256 so the
+// lookup doesn't compare secrets byte by byte. With no keys configured
+// authentication is off and every request is let through.
+type Authenticator struct {
+	keys     map[[sha256.Size]byte]*APIKey
+	failures *RateLimiter
+}
+
+type apiKeyContextKey struct{}
+
+// NewAuthenticator checks and indexes keys. Names must be unique, since
+// rate limits count requests per key name, and so must
+// secrets, or one key's permissions would silently replace another's.
+func NewAuthenticator(keys []APIKey) (*Authenticator, error) {
+	auth := &Authenticator{keys: make(map[[sha256.Size]byte]*APIKey, len(keys))}
+	names := make(map[string]bool, len(keys))
+	for i := range keys {
+		key := &keys[i]
+		if err := key.validate(); err != nil {
+			return nil, err
+		}
+		if names[key.Name] {
+			return nil, fmt.Errorf("more than one key is named %q", key.Name)
+		}
+		names[key.Name] = true
+		hash := sha256.Sum256([]byte(key.Key))
+		if other, found := auth.keys[hash]; found {
+			return nil, fmt.Errorf("keys %q and %q have the same secret", other.Name, key.Name)
+		}
+		auth.keys[hash] = key
+	}
+	return auth, nil
+}
+
+func (a *Authenticator) Enabled() bool {
+	return len(a.keys) > 0
+}
+
+// ThrottleFailures limits failed attempts per IP address with the
+// limiter's auth_failures route. Rate limits per key only apply once a key
+// is known, so without this invalid keys could be tried without limit.
+func (a *Authenticator) ThrottleFailures(limiter *RateLimiter) {
+	a.failures = limiter
+}
+
+// Require wraps a handler so it only runs for keys allowed to perform op.
+// The key is stored in the request context for table checks further in.
+// Preflight requests pass through, since browsers never send credentials
+// with them.
+func (a *Authenticator) Require(op string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.Enabled() || r.Method == "OPTIONS" {
+			next(w, r)
+			return
+		}
+
+		if a.failures != nil && a.failures.Blocked(w, r) {
+			return
+		}
+
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		key := a.keys[sha256.Sum256([]byte(token))]
+		if !found || key == nil {
+			if a.failures != nil {
+				a.failures.Failed(r)
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="lightning-search"`)
+			http.Error(w, "Invalid or missing API key", http.StatusUnauthorized)
+			return
+		}
+		if !key.AllowsOperation(op) {
+			http.Error(w, fmt.Sprintf("API key is not allowed to %s", op), http.StatusForbidden)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key)))
+	}
+}
+
+// requestKey returns the key a request was authenticated with, or nil
+// when authentication is off.
+func requestKey(r *http.Request) *APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey{}).(*APIKey)
+	return key
+}
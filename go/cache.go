@@ -0,0 +1,293 @@
+package main
+
+import (
+	"container/list"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cacheShards is the number of independently locked LRU lists. Keys are
+// spread across shards by hash so concurrent searches rarely contend.
+const cacheShards = 16
+
+// Cache is a sharded LRU cache with a memory budget. Each shard evicts its
+// least recently used entries once it goes over its share of the budget,
+// and a background janitor removes expired entries that are never read.
+//
+// Entries can outlive their TTL by a grace window, during which GetStale
+// still returns them so callers can serve stale data while refreshing.
+//
+// Entries can be tagged when they are set, e.g. with the table and the
+// document IDs they contain, and later invalidated by tag.
+type Cache[V any] struct {
+	shards [cacheShards]*cacheShard[V]
+	sizeOf func(key string, value V) int
+	stop   chan struct{}
+
+	hits          atomic.Int64
+	staleHits     atomic.Int64
+	misses        atomic.Int64
+	evictions     atomic.Int64
+	expirations   atomic.Int64
+	invalidations atomic.Int64
+}
+
+type cacheShard[V any] struct {
+	mutex  sync.Mutex
+	items  map[string]*list.Element
+	tags   map[string]map[string]struct{} // tag to the keys carrying it
+	order  *list.List                     // front is most recently used
+	bytes  int
+	budget int
+}
+
+type cacheEntry[V any] struct {
+	key        string
+	value      V
+	size       int
+	expiration time.Time
+	staleUntil time.Time
+	tags       []string
+}
+
+// CacheStats is a point-in-time view of the cache counters.
+type CacheStats struct {
+	Backend       string `json:"backend"`
+	Entries       int    `json:"entries"`
+	Bytes         int    `json:"bytes"`
+	MaxBytes      int    `json:"max_bytes"`
+	Hits          int64  `json:"hits"`
+	StaleHits     int64  `json:"stale_hits"`
+	Misses        int64  `json:"misses"`
+	Evictions     int64  `json:"evictions"`
+	Expirations   int64  `json:"expirations"`
+	Invalidations int64  `json:"invalidations"`
+
+	// SharedAvailable is set when a shared backend is configured and
+	// currently reachable
+	SharedAvailable bool `json:"shared_available,omitempty"`
+}
+
+// NewCache creates a cache holding at most maxBytes, as estimated by sizeOf,
+// and starts a janitor that sweeps expired entries every janitorInterval.
+func NewCache[V any](maxBytes int, janitorInterval time.Duration, sizeOf func(key string, value V) int) *Cache[V] {
+	c := &Cache[V]{
+		sizeOf: sizeOf,
+		stop:   make(chan struct{}),
+	}
+	for i := range c.shards {
+		c.shards[i] = &cacheShard[V]{
+			items:  make(map[string]*list.Element),
+			tags:   make(map[string]map[string]struct{}),
+			order:  list.New(),
+			budget: maxBytes / cacheShards,
+		}
+	}
+	if janitorInterval > 0 {
+		go c.janitor(janitorInterval)
+	}
+	return c
+}
+
+func (c *Cache[V]) shard(key string) *cacheShard[V] {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return c.shards[h.Sum32()%cacheShards]
+}
+
+// Set stores value as fresh for duration, then stale for a further grace,
+// under the given invalidation tags.
+func (c *Cache[V]) Set(key string, value V, duration, grace time.Duration, tags ...string) {
+	size := c.sizeOf(key, value)
+	for _, tag := range tags {
+		size += len(tag) + 32
+	}
+	s := c.shard(key)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if el, found := s.items[key]; found {
+		s.remove(el)
+	}
+
+	// An entry bigger than the whole shard would only evict everything
+	// else and then itself
+	if size > s.budget {
+		return
+	}
+
+	expiration := time.Now().Add(duration)
+	s.items[key] = s.order.PushFront(&cacheEntry[V]{
+		key:        key,
+		value:      value,
+		size:       size,
+		expiration: expiration,
+		staleUntil: expiration.Add(grace),
+		tags:       tags,
+	})
+	s.bytes += size
+	for _, tag := range tags {
+		if s.tags[tag] == nil {
+			s.tags[tag] = make(map[string]struct{})
+		}
+		s.tags[tag][key] = struct{}{}
+	}
+
+	for s.bytes > s.budget {
+		s.remove(s.order.Back())
+		c.evictions.Add(1)
+	}
+}
+
+// Get returns the entry for key only while it is fresh.
+func (c *Cache[V]) Get(key string) (V, bool) {
+	value, stale, found := c.GetStale(key)
+	if stale {
+		var zero V
+		return zero, false
+	}
+	return value, found
+}
+
+// GetStale returns the entry for key while it is fresh or within its grace
+// window, and reports which.
+func (c *Cache[V]) GetStale(key string) (value V, stale bool, found bool) {
+	s := c.shard(key)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	el, found := s.items[key]
+	if !found {
+		c.misses.Add(1)
+		return value, false, false
+	}
+	entry := el.Value.(*cacheEntry[V])
+	now := time.Now()
+	if now.After(entry.staleUntil) {
+		s.remove(el)
+		c.expirations.Add(1)
+		c.misses.Add(1)
+		return value, false, false
+	}
+
+	s.order.MoveToFront(el)
+	if now.After(entry.expiration) {
+		c.staleHits.Add(1)
+		return entry.value, true, true
+	}
+	c.hits.Add(1)
+	return entry.value, false, true
+}
+
+func (c *Cache[V]) Stats() CacheStats {
+	stats := CacheStats{
+		Backend:       "local",
+		Hits:          c.hits.Load(),
+		StaleHits:     c.staleHits.Load(),
+		Misses:        c.misses.Load(),
+		Evictions:     c.evictions.Load(),
+		Expirations:   c.expirations.Load(),
+		Invalidations: c.invalidations.Load(),
+	}
+	for _, s := range c.shards {
+		s.mutex.Lock()
+		stats.Entries += len(s.items)
+		stats.Bytes += s.bytes
+		stats.MaxBytes += s.budget
+		s.mutex.Unlock()
+	}
+	return stats
+}
+
+// InvalidateTag removes every entry carrying tag and returns how many.
+func (c *Cache[V]) InvalidateTag(tag string) int {
+	removed := 0
+	for _, s := range c.shards {
+		s.mutex.Lock()
+		for key := range s.tags[tag] {
+			s.remove(s.items[key])
+			removed++
+		}
+		s.mutex.Unlock()
+	}
+	c.invalidations.Add(int64(removed))
+	return removed
+}
+
+// InvalidatePrefix removes every entry whose key starts with prefix and
+// returns how many.
+func (c *Cache[V]) InvalidatePrefix(prefix string) int {
+	removed := 0
+	for _, s := range c.shards {
+		s.mutex.Lock()
+		for key, el := range s.items {
+			if strings.HasPrefix(key, prefix) {
+				s.remove(el)
+				removed++
+			}
+		}
+		s.mutex.Unlock()
+	}
+	c.invalidations.Add(int64(removed))
+	return removed
+}
+
+// Clear removes every entry and returns how many there were.
+func (c *Cache[V]) Clear() int {
+	return c.InvalidatePrefix("")
+}
+
+// Close stops the janitor.
+func (c *Cache[V]) Close() {
+	close(c.stop)
+}
+
+func (c *Cache[V]) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.sweep(time.Now())
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// sweep removes expired entries one shard at a time, so searches on other
+// shards are never blocked by it.
+func (c *Cache[V]) sweep(now time.Time) {
+	for _, s := range c.shards {
+		s.mutex.Lock()
+		for el := s.order.Back(); el != nil; {
+			prev := el.Prev()
+			if now.After(el.Value.(*cacheEntry[V]).staleUntil) {
+				s.remove(el)
+				c.expirations.Add(1)
+			}
+			el = prev
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// remove unlinks an entry; the caller must hold the shard lock.
+func (s *cacheShard[V]) remove(el *list.Element) {
+	entry := el.Value.(*cacheEntry[V])
+	s.order.Remove(el)
+	delete(s.items, entry.key)
+	s.bytes -= entry.size
+	for _, tag := range entry.tags {
+		delete(s.tags[tag], entry.key)
+		if len(s.tags[tag]) == 0 {
+			delete(s.tags, tag)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// InvalidateRequest selects cache entries to drop. Table alone drops every
+// entry for that table; with IDs it drops only the entries containing one
+// of those documents. Prefix drops entries by cache key prefix.
+type InvalidateRequest struct {
+	Table  string   `json:"table"`
+	IDs    []string `json:"ids"`
+	Prefix string   `json:"prefix"`
+}
+
+func tableTag(table string) string {
+	return "table:" + table
+}
+
+func documentTag(table, id string) string {
+	return "doc:" + table + ":" + id
+}
+
+// cacheTags tags a cached result with its table and every document it
+// contains, so a change to one record can drop just the affected entries.
+func cacheTags(tableConfig *TableConfig, results []map[string]interface{}) []string {
+	tags := make([]string, 0, len(results)+1)
+	tags = append(tags, tableTag(tableConfig.Name))
+	for _, row := range results {
+		tags = append(tags, documentTag(tableConfig.Name, rowID(row[tableConfig.PrimaryKey])))
+	}
+	return tags
+}
+
+// handleCacheInvalidate serves POST /cache/invalidate.
+func handleCacheInvalidate(cache CacheBackend) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req InvalidateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Error parsing request JSON", http.StatusBadRequest)
+			return
+		}
+
+		table := req.Table
+		if table == "" {
+			// Cache keys start with their table; a prefix that doesn't
+			// name one may span tables, so needs a key allowed every table
+			table = "*"
+			if before, _, found := strings.Cut(req.Prefix, ":"); found {
+				table = before
+			}
+		}
+		if !requestKey(r).AllowsTable(table) {
+			http.Error(w, "API key is not allowed to access this table", http.StatusForbidden)
+			return
+		}
+
+		removed := 0
+		var err error
+		switch {
+		case req.Table != "" && len(req.IDs) > 0:
+			for _, id := range req.IDs {
+				var n int
+				n, err = cache.InvalidateTag(documentTag(req.Table, id))
+				removed += n
+				if err != nil {
+					break
+				}
+			}
+		case req.Table != "":
+			removed, err = cache.InvalidateTag(tableTag(req.Table))
+		case req.Prefix != "":
+			removed, err = cache.InvalidatePrefix(req.Prefix)
+		default:
+			http.Error(w, "One of table or prefix is required", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			sharedCacheUnavailable(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"invalidated": removed,
+		})
+	}
+}
+
+// handleCacheStats serves GET /cache/stats.
+func handleCacheStats(cache CacheBackend) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cache.Stats())
+	}
+}
+
+// handleCacheClear serves DELETE /cache.
+func handleCacheClear(cache CacheBackend) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !requestKey(r).AllowsTable("*") {
+			http.Error(w, "API key is not allowed to access every table", http.StatusForbidden)
+			return
+		}
+
+		removed, err := cache.Clear()
+		if err != nil {
+			sharedCacheUnavailable(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"invalidated": removed,
+		})
+	}
+}
+
+// sharedCacheUnavailable answers an invalidation the shared cache couldn't
+// apply. Its entries would be served again once it is back, so the caller
+// has to retry rather than treat them as dropped.
+func sharedCacheUnavailable(w http.ResponseWriter, r *http.Request, err error) {
+	slog.ErrorContext(r.Context(), "Cache invalidation failed", "error", err)
+	http.Error(w, "Shared cache unavailable, invalidation not applied", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// CacheBackend stores search results. The in-process Cache is the default;
+// RedisCache shares entries between service instances.
+type CacheBackend interface {
+	GetStale(key string) (value CachedResult, stale bool, found bool)
+	Set(key string, value CachedResult, duration, grace time.Duration, tags ...string)
+	InvalidateTag(tag string) (int, error)
+	InvalidatePrefix(prefix string) (int, error)
+	Clear() (int, error)
+	Stats() CacheStats
+	Close()
+}
+
+// fallbackCache uses a shared backend while it is reachable and falls back
+// to the local in-process cache when it is not. After a failure the shared
+// backend is left alone for retryAfter before it is tried again, so an
+// outage costs one timeout per interval rather than one per search.
+// Invalidations are applied to both and always try the shared backend,
+// even while it is marked down. When it can't be reached they fail, since
+// its entries would be served again once it is back.
+type fallbackCache struct {
+	shared     *RedisCache
+	local      *Cache[CachedResult]
+	retryAfter time.Duration
+	downUntil  atomic.Int64 // unix nanoseconds
+}
+
+// localBackend serves the in-process cache on its own, where invalidations
+// can't fail.
+type localBackend struct {
+	*Cache[CachedResult]
+}
+
+func (c localBackend) InvalidateTag(tag string) (int, error) {
+	return c.Cache.InvalidateTag(tag), nil
+}
+
+func (c localBackend) InvalidatePrefix(prefix string) (int, error) {
+	return c.Cache.InvalidatePrefix(prefix), nil
+}
+
+func (c localBackend) Clear() (int, error) {
+	return c.Cache.Clear(), nil
+}
+
+func newFallbackCache(shared *RedisCache, local *Cache[CachedResult], retryAfter time.Duration) *fallbackCache {
+	return &fallbackCache{
+		shared:     shared,
+		local:      local,
+		retryAfter: retryAfter,
+	}
+}
+
+func (c *fallbackCache) available() bool {
+	return time.Now().UnixNano() >= c.downUntil.Load()
+}
+
+func (c *fallbackCache) failed(err error) {
+	if c.available() {
+		slog.Warn("Shared cache unavailable, using local cache", "retry_after", c.retryAfter.String(), "error", err)
+	}
+	c.downUntil.Store(time.Now().Add(c.retryAfter).UnixNano())
+}
+
+func (c *fallbackCache) GetStale(key string) (CachedResult, bool, bool) {
+	if c.available() {
+		value, stale, found, err := c.shared.GetStale(key)
+		if err == nil {
+			return value, stale, found
+		}
+		c.failed(err)
+	}
+	return c.local.GetStale(key)
+}
+
+func (c *fallbackCache) Set(key string, value CachedResult, duration, grace time.Duration, tags ...string) {
+	if c.available() {
+		err := c.shared.Set(key, value, duration, grace, tags...)
+		if err == nil {
+			return
+		}
+		c.failed(err)
+	}
+	c.local.Set(key, value, duration, grace, tags...)
+}
+
+func (c *fallbackCache) InvalidateTag(tag string) (int, error) {
+	removed := c.local.InvalidateTag(tag)
+	n, err := c.shared.InvalidateTag(tag)
+	if err != nil {
+		c.failed(err)
+		return removed, err
+	}
+	return removed + n, nil
+}
+
+func (c *fallbackCache) InvalidatePrefix(prefix string) (int, error) {
+	removed := c.local.InvalidatePrefix(prefix)
+	n, err := c.shared.InvalidatePrefix(prefix)
+	if err != nil {
+		c.failed(err)
+		return removed, err
+	}
+	return removed + n, nil
+}
+
+func (c *fallbackCache) Clear() (int, error) {
+	return c.InvalidatePrefix("")
+}
+
+// Stats reports the shared backend's counters with the local cache's
+// entries, which are only populated while the shared backend is down.
+func (c *fallbackCache) Stats() CacheStats {
+	stats := c.shared.Stats()
+	local := c.local.Stats()
+	stats.Entries = local.Entries
+	stats.Bytes = local.Bytes
+	stats.MaxBytes = local.MaxBytes
+	stats.Hits += local.Hits
+	stats.StaleHits += local.StaleHits
+	stats.Misses += local.Misses
+	stats.Evictions += local.Evictions
+	stats.Expirations += local.Expirations
+	stats.Invalidations += local.Invalidations
+	stats.SharedAvailable = c.available()
+	return stats
+}
+
+func (c *fallbackCache) Close() {
+	c.shared.Close()
+	c.local.Close()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// CanonicalSearch is the normalized form of a search request. Requests that
+// would return the same results have the same canonical form, and so share
+// a cache entry; anything that changes the results is part of it.
+type CanonicalSearch struct {
+	Table string
+	Mode  string
+	Query string
+	Terms []string
+	Scope SearchScope
+	// Trashed is which soft-deleted rows to include, see trashed.go
+	Trashed string
+}
+
+// canonicalMode maps a requested mode to the mode that actually runs;
+// anything that isn't fulltext or auto runs as LIKE.
+func canonicalMode(mode string) string {
+	switch mode {
+	case strategyFulltext, modeAuto:
+		return mode
+	default:
+		return strategyLike
+	}
+}
+
+// bareTermPattern matches a boolean-mode term whose position can't change
+// its meaning: a word with at most a leading + or -. Grouping, phrases,
+// relevance operators and truncation all depend on where they appear.
+var bareTermPattern = regexp.MustCompile(`^[+-]?[^+\-<>()~*"@]+$`)
+
+// canonicalSearch normalizes a request. The query is lowercased, since the
+// searchable columns use case-insensitive collations, and runs of
+// whitespace collapse to one space. For FULLTEXT-only searches made of bare
+// terms the terms are also sorted, as their order does not affect what
+// MATCH ... AGAINST returns; LIKE and auto searches keep their order
+// because LIKE matches the query as a phrase.
+func canonicalSearch(req SearchRequest, scope SearchScope) CanonicalSearch {
+	// Conflicting options are rejected before the search runs
+	trashed, _ := req.trashed()
+	terms := strings.Fields(strings.ToLower(req.Query))
+	mode := canonicalMode(req.Mode)
+	if mode == strategyFulltext && bareTerms(terms) {
+		sort.Strings(terms)
+	}
+	return CanonicalSearch{
+		Table:   req.Table,
+		Mode:    mode,
+		Query:   strings.Join(terms, " "),
+		Terms:   terms,
+		Scope:   scope,
+		Trashed: trashed,
+	}
+}
+
+func bareTerms(terms []string) bool {
+	for _, term := range terms {
+		if !bareTermPattern.MatchString(term) {
+			return false
+		}
+	}
+	return true
+}
+
+// Key is the cache key for the search. It starts with the table and query
+// so entries can be invalidated by prefix. Searches including trashed rows
+// add a segment after the mode, and a scope is appended as JSON,
+// whose quoting keeps one scope from ever producing another's key; map keys
+// are marshalled in sorted order, so the key is deterministic.
+func (c CanonicalSearch) Key() string {
+	key := c.Table + ":" + c.Query + ":" + c.Mode
+	if c.Trashed != trashedExclude {
+		key += ":" + c.Trashed + "_trashed"
+	}
+	if !c.Scope.IsZero() {
+		scope, _ := json.Marshal(c.Scope)
+		key += "#" + string(scope)
+	}
+	return key
+}
+
+// Request returns the search to execute, so every request sharing a cache
+// entry runs exactly the same query.
+func (c CanonicalSearch) Request(explain bool) SearchRequest {
+	return SearchRequest{
+		Table:       c.Table,
+		Query:       c.Query,
+		Mode:        c.Mode,
+		Explain:     explain,
+		WithTrashed: c.Trashed == trashedWith,
+		OnlyTrashed: c.Trashed == trashedOnly,
+	}
+}
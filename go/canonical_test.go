@@ -0,0 +1,71 @@
+package main
+
+import "testing"
+
+func TestCanonicalSearchKeyIsolatesScopes(t *testing.T) {
+	search := func(scope SearchScope) string {
+		return canonicalSearch(SearchRequest{Table: "companies", Query: "Acme", Mode: "fulltext"}, scope).Key()
+	}
+
+	scopes := []SearchScope{
+		{},
+		{Tenant: "acme"},
+		{Tenant: "beta"},
+		// Tenant values that try to look like another scope's key
+		{Tenant: `acme","constraints":{"region":["east"]}`},
+		{Tenant: "acme#"},
+		{Tenant: "acme", Constraints: map[string][]string{"region": {"east"}}},
+		{Tenant: "acme", Constraints: map[string][]string{"region": {"east", "west"}}},
+		{Tenant: "acme", Constraints: map[string][]string{"region": {"east,west"}}},
+		{Tenant: "acme", Constraints: map[string][]string{"region": {}}},
+		{Tenant: "acme", Constraints: map[string][]string{"store_id": {"east"}}},
+		{Constraints: map[string][]string{"region": {"east"}}},
+	}
+
+	seen := make(map[string]int)
+	for i, scope := range scopes {
+		key := search(scope)
+		if j, found := seen[key]; found {
+			t.Errorf("scopes %+v and %+v share the key %q", scopes[j], scope, key)
+		}
+		seen[key] = i
+	}
+
+	if key := search(SearchScope{}); key != "companies:acme:fulltext" {
+		t.Errorf("unscoped key = %q, want companies:acme:fulltext", key)
+	}
+}
+
+func TestCanonicalSearchKeyIsDeterministic(t *testing.T) {
+	scope := SearchScope{Tenant: "acme", Constraints: map[string][]string{"region": {"east"}, "store_id": {"1", "2"}}}
+	first := canonicalSearch(SearchRequest{Table: "companies", Query: "acme", Mode: "like"}, scope).Key()
+	for i := 0; i < 20; i++ {
+		if key := canonicalSearch(SearchRequest{Table: "companies", Query: "acme", Mode: "like"}, scope).Key(); key != first {
+			t.Fatalf("key changed from %q to %q", first, key)
+		}
+	}
+}
+
+func TestCanonicalSearchKey(t *testing.T) {
+	tests := []struct {
+		name string
+		req  SearchRequest
+		key  string
+	}{
+		{"case and spacing", SearchRequest{Table: "companies", Query: "  Acme   Holdings ", Mode: "like"}, "companies:acme holdings:like"},
+		{"unknown mode runs as like", SearchRequest{Table: "companies", Query: "acme", Mode: "regex"}, "companies:acme:like"},
+		{"fulltext terms sorted", SearchRequest{Table: "companies", Query: "holdings +acme", Mode: "fulltext"}, "companies:+acme holdings:fulltext"},
+		{"auto keeps order", SearchRequest{Table: "companies", Query: "holdings acme", Mode: "auto"}, "companies:holdings acme:auto"},
+		{"grouping keeps order", SearchRequest{Table: "companies", Query: "+acme -(beta gamma)", Mode: "fulltext"}, "companies:+acme -(beta gamma):fulltext"},
+		{"with trashed", SearchRequest{Table: "companies", Query: "acme", Mode: "like", WithTrashed: true}, "companies:acme:like:with_trashed"},
+		{"only trashed", SearchRequest{Table: "companies", Query: "acme", Mode: "like", OnlyTrashed: true}, "companies:acme:like:only_trashed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if key := canonicalSearch(tt.req, SearchScope{}).Key(); key != tt.key {
+				t.Errorf("Key = %q, want %q", key, tt.key)
+			}
+		})
+	}
+}
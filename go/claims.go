@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// headerClaims carries claims the Laravel app makes about the user a
+// search is for.
+const headerClaims = "X-Lightning-Claims"
+
+// Claims are signed statements about who a search is for. They are
+// encoded as base64url(JSON) "." base64url(HMAC-SHA256(JSON)) and must
+// carry an expiry, in unix seconds.
+type Claims struct {
+	Tenant      string              `json:"tenant,omitempty"`
+	Constraints map[string][]string `json:"constraints,omitempty"`
+	Expires     int64               `json:"exp"`
+}
+
+var (
+	errClaimsInvalid = errors.New("invalid claims signature")
+	errClaimsExpired = errors.New("claims have expired")
+)
+
+// ClaimsVerifier checks claims against the shared secret.
+type ClaimsVerifier struct {
+	secret []byte
+}
+
+func NewClaimsVerifier(secret string) *ClaimsVerifier {
+	return &ClaimsVerifier{secret: []byte(secret)}
+}
+
+// FromRequest returns the request's claims, or nil when it has none.
+func (v *ClaimsVerifier) FromRequest(r *http.Request) (*Claims, error) {
+	token := r.Header.Get(headerClaims)
+	if token == "" {
+		return nil, nil
+	}
+	if len(v.secret) == 0 {
+		return nil, errors.New("claims were sent but no claims secret is configured")
+	}
+	return v.Verify(token, time.Now())
+}
+
+// Verify decodes a claims token, checking its signature and expiry.
+func (v *ClaimsVerifier) Verify(token string, now time.Time) (*Claims, error) {
+	payload, signature, found := strings.Cut(token, ".")
+	if !found {
+		return nil, errClaimsInvalid
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errClaimsInvalid
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, errClaimsInvalid
+	}
+
+	mac := hmac.New(sha256.New, v.secret)
+	mac.Write(data)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return nil, errClaimsInvalid
+	}
+
+	var claims Claims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, errClaimsInvalid
+	}
+	if claims.Expires == 0 || now.Unix() > claims.Expires {
+		return nil, errClaimsExpired
+	}
+	return &claims, nil
+}
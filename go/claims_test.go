@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signClaims encodes claims the way the PHP client does.
+func signClaims(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestClaimsVerifierVerify(t *testing.T) {
+	verifier := NewClaimsVerifier("secret")
+	now := time.Unix(1700000000, 0)
+	valid := `{"tenant":"acme","constraints":{"region":["north","east"]},"exp":1700000060}`
+	token := signClaims("secret", valid)
+	_, signature, _ := strings.Cut(token, ".")
+	forged := base64.RawURLEncoding.EncodeToString([]byte(strings.Replace(valid, "acme", "beta", 1)))
+
+	tests := []struct {
+		name   string
+		token  string
+		tenant string
+		err    error
+	}{
+		{"valid", token, "acme", nil},
+		{"expires this second", signClaims("secret", `{"tenant":"acme","exp":1700000000}`), "acme", nil},
+		{"expired", signClaims("secret", `{"tenant":"acme","exp":1699999999}`), "", errClaimsExpired},
+		{"no expiry", signClaims("secret", `{"tenant":"acme"}`), "", errClaimsExpired},
+		{"wrong secret", signClaims("other", valid), "", errClaimsInvalid},
+		{"tampered payload", forged + "." + signature, "", errClaimsInvalid},
+		{"tampered signature", token[:len(token)-2] + "AA", "", errClaimsInvalid},
+		{"no signature", base64.RawURLEncoding.EncodeToString([]byte(valid)), "", errClaimsInvalid},
+		{"empty signature", base64.RawURLEncoding.EncodeToString([]byte(valid)) + ".", "", errClaimsInvalid},
+		{"not base64", "not base64!.AA", "", errClaimsInvalid},
+		{"signed garbage", signClaims("secret", "not json"), "", errClaimsInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := verifier.Verify(tt.token, now)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Verify error = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				if claims != nil {
+					t.Errorf("Verify returned claims %+v with an error", claims)
+				}
+				return
+			}
+			if claims.Tenant != tt.tenant {
+				t.Errorf("tenant = %q, want %q", claims.Tenant, tt.tenant)
+			}
+		})
+	}
+}
+
+func TestClaimsVerifierFromRequest(t *testing.T) {
+	token := signClaims("secret", `{"tenant":"acme","exp":`+strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)+`}`)
+
+	r := httptest.NewRequest("POST", "/search", nil)
+	if claims, err := NewClaimsVerifier("secret").FromRequest(r); claims != nil || err != nil {
+		t.Errorf("FromRequest without claims = %+v, %v; want nil, nil", claims, err)
+	}
+
+	r.Header.Set(headerClaims, token)
+	if claims, err := NewClaimsVerifier("secret").FromRequest(r); err != nil || claims.Tenant != "acme" {
+		t.Errorf("FromRequest = %+v, %v; want tenant acme", claims, err)
+	}
+	// Claims can't be trusted, or ignored, without a secret to check them
+	if _, err := NewClaimsVerifier("").FromRequest(r); err == nil {
+		t.Error("FromRequest accepted claims with no secret configured")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// CORSPolicy decides which browser origins may call the service. Origins
+// are exact ("https://app.example.com"), patterns ("https://*.example.com")
+// or "*" for any origin. "*" in Headers allows whatever headers the browser
+// asks for.
+type CORSPolicy struct {
+	Origins       []string `json:"allowed_origins"`
+	Methods       []string `json:"allowed_methods"`
+	Headers       []string `json:"allowed_headers"`
+	ExposeHeaders []string `json:"exposed_headers"`
+	Credentials   bool     `json:"supports_credentials"`
+	MaxAge        int      `json:"max_age"` // seconds browsers may cache a preflight
+}
+
+// defaultCORSPolicy allows any origin without credentials, as the service
+// always has.
+func defaultCORSPolicy() CORSPolicy {
+	return CORSPolicy{
+		Origins:       []string{"*"},
+		Methods:       []string{"GET", "POST", "DELETE"},
+		Headers:       []string{"Content-Type", "Authorization", "X-Search-Priority"},
+		ExposeHeaders: []string{"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy", "Retry-After", "X-Request-ID"},
+		MaxAge:        600,
+	}
+}
+
+// validate rejects a policy that would let any site make credentialed
+// requests: with credentials the origin is echoed back, so "*" would
+// allow every origin.
+func (p *CORSPolicy) validate() error {
+	if !p.Credentials {
+		return nil
+	}
+	for _, allowed := range p.Origins {
+		if allowed == "*" {
+			return errors.New("CORS allowed origins can't include \"*\" when credentials are supported; list the origins instead")
+		}
+	}
+	return nil
+}
+
+func (p *CORSPolicy) allowsOrigin(origin string) bool {
+	for _, allowed := range p.Origins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		// "*" in a pattern stops at "/", so it only spans host labels
+		if matched, _ := path.Match(allowed, origin); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *CORSPolicy) allowsMethod(method string) bool {
+	for _, allowed := range p.Methods {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap applies the policy to every response and answers preflight
+// requests itself, before authentication, since browsers send preflights
+// without credentials.
+func (p *CORSPolicy) Wrap(next http.Handler) http.Handler {
+	anyOrigin := len(p.Origins) == 1 && p.Origins[0] == "*" && !p.Credentials
+	anyHeader := len(p.Headers) == 1 && p.Headers[0] == "*"
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header := w.Header()
+		if !anyOrigin {
+			header.Add("Vary", "Origin")
+		}
+		if !p.allowsOrigin(origin) {
+			// Without CORS headers the browser blocks the response
+			if preflight {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if anyOrigin {
+			header.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			header.Set("Access-Control-Allow-Origin", origin)
+		}
+		if p.Credentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			if len(p.ExposeHeaders) > 0 {
+				header.Set("Access-Control-Expose-Headers", strings.Join(p.ExposeHeaders, ", "))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header.Add("Vary", "Access-Control-Request-Method")
+		header.Add("Vary", "Access-Control-Request-Headers")
+		if !p.allowsMethod(r.Header.Get("Access-Control-Request-Method")) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		header.Set("Access-Control-Allow-Methods", strings.Join(p.Methods, ", "))
+		if anyHeader {
+			header.Set("Access-Control-Allow-Headers", r.Header.Get("Access-Control-Request-Headers"))
+		} else {
+			header.Set("Access-Control-Allow-Headers", strings.Join(p.Headers, ", "))
+		}
+		if p.MaxAge > 0 {
+			header.Set("Access-Control-Max-Age", strconv.Itoa(p.MaxAge))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SearchExplain describes how a response was produced: the SQL that ran,
+// MySQL's plan for it, and why each hit ranked where it did.
+type SearchExplain struct {
+	SQL      string                   `json:"sql"`
+	Args     []interface{}            `json:"args"`
+	Plan     []map[string]interface{} `json:"plan"`
+	Terms    []string                 `json:"terms"`
+	Hits     []HitExplain             `json:"hits"`
+	Excluded []RuleAdjustment         `json:"excluded,omitempty"`
+}
+
+type HitExplain struct {
+	ID       string          `json:"id"`
+	Position int             `json:"position"`
+	Score    float64         `json:"score"`
+	Fields   []FieldExplain  `json:"fields"`
+	Rule     *RuleAdjustment `json:"rule,omitempty"`
+}
+
+// FieldExplain lists the query terms found in one field. MySQL only reports
+// a single relevance per row, so Contribution is that score split across
+// the matching fields in proportion to how many terms each one matched.
+type FieldExplain struct {
+	Field        string   `json:"field"`
+	Terms        []string `json:"terms"`
+	Contribution float64  `json:"contribution"`
+}
+
+// explainTerms splits a query into the bare terms it searches for,
+// stripping MySQL boolean-mode operators.
+func explainTerms(query string) []string {
+	var terms []string
+	for _, field := range strings.Fields(strings.ToLower(query)) {
+		term := strings.Trim(field, `+-~<>()*"@`)
+		if term != "" {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// explainSearch runs EXPLAIN for the executed query and attributes each
+// hit's score to the fields and terms it matched.
+func explainSearch(ctx context.Context, db *sql.DB, tableConfig *TableConfig, query string, args []interface{}, terms []string, results []map[string]interface{}, adjustments []RuleAdjustment) (*SearchExplain, error) {
+	rows, err := db.QueryContext(ctx, "EXPLAIN "+query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error running EXPLAIN: %v", err)
+	}
+	defer rows.Close()
+	plan, err := scanRows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	explain := &SearchExplain{
+		SQL:   query,
+		Args:  args,
+		Plan:  plan,
+		Terms: terms,
+		Hits:  make([]HitExplain, 0, len(results)),
+	}
+
+	pinned := make(map[string]RuleAdjustment)
+	for _, adjustment := range adjustments {
+		if adjustment.Action == "pinned" {
+			pinned[adjustment.ID] = adjustment
+		} else {
+			explain.Excluded = append(explain.Excluded, adjustment)
+		}
+	}
+
+	for i, row := range results {
+		hit := HitExplain{
+			ID:       rowID(row[tableConfig.PrimaryKey]),
+			Position: i + 1,
+			Score:    rowScore(row),
+		}
+		if adjustment, ok := pinned[hit.ID]; ok {
+			hit.Rule = &adjustment
+		}
+
+		matchedTerms := 0
+		for _, field := range tableConfig.SearchableFields {
+			value, ok := row[field]
+			if !ok || value == nil {
+				continue
+			}
+			text := strings.ToLower(fmt.Sprint(value))
+			var found []string
+			for _, term := range terms {
+				if strings.Contains(text, term) {
+					found = append(found, term)
+				}
+			}
+			if len(found) > 0 {
+				hit.Fields = append(hit.Fields, FieldExplain{Field: field, Terms: found})
+				matchedTerms += len(found)
+			}
+		}
+		for j := range hit.Fields {
+			hit.Fields[j].Contribution = hit.Score * float64(len(hit.Fields[j].Terms)) / float64(matchedTerms)
+		}
+
+		explain.Hits = append(explain.Hits, hit)
+	}
+
+	return explain, nil
+}
+
+// rowScore reads the relevance column, which the driver may return as a
+// number or as text depending on the query.
+func rowScore(row map[string]interface{}) float64 {
+	value, ok := row["relevance"]
+	if !ok || value == nil {
+		return 0
+	}
+	score, err := strconv.ParseFloat(fmt.Sprint(value), 64)
+	if err != nil {
+		return 0
+	}
+	return score
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// headerRequestID carries the ID that ties a request to its log lines. A
+// caller's ID is kept when it looks sane, so one ID can follow a search from
+// the Laravel app through the service.
+const headerRequestID = "X-Request-ID"
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// redactQueries hides search text and query parameters from logs. It is set
+// once at startup, alongside the default logger.
+var redactQueries bool
+
+// setupLogging installs the default logger. Level is debug, info, warn or
+// error; format is text or json.
+func setupLogging(level, format string, redact bool) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q", level)
+	}
+
+	options := &slog.HandlerOptions{Level: lvl}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	case "text", "":
+		handler = slog.NewTextHandler(os.Stderr, options)
+	default:
+		return fmt.Errorf("invalid log format %q, expected text or json", format)
+	}
+
+	slog.SetDefault(slog.New(contextHandler{handler}))
+	redactQueries = redact
+	return nil
+}
+
+// fatal logs an error and exits, for startup failures.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+type requestIDKey struct{}
+
+// contextHandler adds the request ID from the context to every record
+// logged with one of slog's Context functions.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withRequestIDs gives every request an ID, echoes it in the response and
+// logs each request once it completes.
+func withRequestIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(headerRequestID)
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(headerRequestID, id)
+
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		slog.InfoContext(ctx, "Request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", recorder.status,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"remote", clientIP(r),
+		)
+	})
+}
+
+// queryAttr logs search text, unless queries are redacted.
+func queryAttr(key, query string) slog.Attr {
+	if redactQueries {
+		return slog.String(key, "[redacted]")
+	}
+	return slog.String(key, query)
+}
+
+// argsAttr logs SQL parameters, which hold the search text and scope
+// values, unless queries are redacted.
+func argsAttr(args []interface{}) slog.Attr {
+	if redactQueries {
+		return slog.Int("args", len(args))
+	}
+	return slog.Any("args", args)
+}
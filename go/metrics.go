@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the histogram upper bounds, in seconds.
+var latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram counts observations into latencyBuckets. Counts are not
+// cumulative here; they are summed when written out.
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(latencyBuckets))}
+}
+
+func (h *histogram) observe(seconds float64) {
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// requestLabels identifies a series of HTTP requests.
+type requestLabels struct {
+	route  string
+	mode   string
+	status string
+}
+
+// requestInfo lets handlers add labels to the request being measured.
+type requestInfo struct {
+	mode string
+}
+
+type requestInfoKey struct{}
+
+// setRequestMode labels the request with the search mode that ran.
+func setRequestMode(r *http.Request, mode string) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.mode = mode
+	}
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Metrics collects request and query timings and writes them, with the
+// state of the cache, database pool, admission governor, rate limiter and
+// Go runtime, in the Prometheus text format.
+type Metrics struct {
+	requests   map[requestLabels]*histogram
+	strategies map[string]*histogram
+	mutex      sync.Mutex
+
+	cache    CacheBackend
+	db       *sql.DB
+	governor *Governor
+	limiter  *RateLimiter
+	started  time.Time
+}
+
+func NewMetrics(cache CacheBackend, db *sql.DB, governor *Governor, limiter *RateLimiter) *Metrics {
+	return &Metrics{
+		requests:   make(map[requestLabels]*histogram),
+		strategies: make(map[string]*histogram),
+		cache:      cache,
+		db:         db,
+		governor:   governor,
+		limiter:    limiter,
+		started:    time.Now(),
+	}
+}
+
+// Wrap times every request to mux. Requests are labelled with the pattern
+// they matched rather than their path, so unknown paths can't create an
+// unbounded number of series.
+func (m *Metrics) Wrap(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &requestInfo{}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "other"
+		}
+		labels := requestLabels{route: route, mode: info.mode, status: strconv.Itoa(recorder.status)}
+
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		h, found := m.requests[labels]
+		if !found {
+			h = newHistogram()
+			m.requests[labels] = h
+		}
+		h.observe(time.Since(start).Seconds())
+	})
+}
+
+// ObserveStrategy records how long one strategy's query took. It is safe
+// to call on a nil Metrics.
+func (m *Metrics) ObserveStrategy(strategy string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	h, found := m.strategies[strategy]
+	if !found {
+		h = newHistogram()
+		m.strategies[strategy] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// metricWriter writes metric families in the Prometheus text format.
+type metricWriter struct {
+	w io.Writer
+}
+
+func (mw metricWriter) family(name, kind, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one sample; labels are name/value pairs.
+func (mw metricWriter) sample(name string, value float64, labels ...string) {
+	fmt.Fprintf(mw.w, "%s%s %s\n", name, formatLabels(labels), strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (mw metricWriter) histogram(name string, h *histogram, labels ...string) {
+	var cumulative uint64
+	for i, bound := range latencyBuckets {
+		cumulative += h.counts[i]
+		mw.sample(name+"_bucket", float64(cumulative), append(labels, "le", strconv.FormatFloat(bound, 'g', -1, 64))...)
+	}
+	mw.sample(name+"_bucket", float64(h.count), append(labels, "le", "+Inf")...)
+	mw.sample(name+"_sum", h.sum, labels...)
+	mw.sample(name+"_count", float64(h.count), labels...)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Write writes every metric to w.
+func (m *Metrics) Write(w io.Writer) {
+	mw := metricWriter{w: w}
+	m.writeRequests(mw)
+	m.writeCache(mw)
+	m.writeDB(mw)
+	m.writeAdmission(mw)
+	m.writeRateLimits(mw)
+	m.writeRuntime(mw)
+}
+
+func (m *Metrics) writeRequests(mw metricWriter) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	labels := make([]requestLabels, 0, len(m.requests))
+	for l := range m.requests {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		a, b := labels[i], labels[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.mode != b.mode {
+			return a.mode < b.mode
+		}
+		return a.status < b.status
+	})
+
+	mw.family("lightning_search_requests_total", "counter", "HTTP requests by route, search mode and status.")
+	for _, l := range labels {
+		mw.sample("lightning_search_requests_total", float64(m.requests[l].count), "route", l.route, "mode", l.mode, "status", l.status)
+	}
+	mw.family("lightning_search_request_duration_seconds", "histogram", "HTTP request latency by route, search mode and status.")
+	for _, l := range labels {
+		mw.histogram("lightning_search_request_duration_seconds", m.requests[l], "route", l.route, "mode", l.mode, "status", l.status)
+	}
+
+	strategies := make([]string, 0, len(m.strategies))
+	for s := range m.strategies {
+		strategies = append(strategies, s)
+	}
+	sort.Strings(strategies)
+	mw.family("lightning_search_strategy_duration_seconds", "histogram", "Database query time per search strategy.")
+	for _, s := range strategies {
+		mw.histogram("lightning_search_strategy_duration_seconds", m.strategies[s], "strategy", s)
+	}
+}
+
+func (m *Metrics) writeCache(mw metricWriter) {
+	stats := m.cache.Stats()
+	counters := []struct {
+		name, help string
+		value      int64
+	}{
+		{"hits", "Cache hits on fresh entries.", stats.Hits},
+		{"stale_hits", "Expired entries served while they were refreshed.", stats.StaleHits},
+		{"misses", "Cache misses.", stats.Misses},
+		{"evictions", "Entries evicted to stay within the byte budget.", stats.Evictions},
+		{"expirations", "Entries dropped after their grace period.", stats.Expirations},
+		{"invalidations", "Entries dropped by invalidation.", stats.Invalidations},
+	}
+	for _, c := range counters {
+		name := "lightning_search_cache_" + c.name + "_total"
+		mw.family(name, "counter", c.help)
+		mw.sample(name, float64(c.value), "backend", stats.Backend)
+	}
+
+	mw.family("lightning_search_cache_entries", "gauge", "Entries in the local cache.")
+	mw.sample("lightning_search_cache_entries", float64(stats.Entries))
+	mw.family("lightning_search_cache_bytes", "gauge", "Estimated size of the local cache.")
+	mw.sample("lightning_search_cache_bytes", float64(stats.Bytes))
+	mw.family("lightning_search_cache_max_bytes", "gauge", "Byte budget of the local cache.")
+	mw.sample("lightning_search_cache_max_bytes", float64(stats.MaxBytes))
+	if stats.Backend != "local" {
+		mw.family("lightning_search_cache_shared_up", "gauge", "Whether the shared cache is reachable.")
+		mw.sample("lightning_search_cache_shared_up", boolValue(stats.SharedAvailable), "backend", stats.Backend)
+	}
+}
+
+func (m *Metrics) writeDB(mw metricWriter) {
+	stats := m.db.Stats()
+	gauges := []struct {
+		name, help string
+		value      float64
+	}{
+		{"max_open_connections", "Maximum open connections to the database.", float64(stats.MaxOpenConnections)},
+		{"open_connections", "Open connections, in use and idle.", float64(stats.OpenConnections)},
+		{"in_use_connections", "Connections currently in use.", float64(stats.InUse)},
+		{"idle_connections", "Idle connections.", float64(stats.Idle)},
+	}
+	for _, g := range gauges {
+		mw.family("lightning_search_db_"+g.name, "gauge", g.help)
+		mw.sample("lightning_search_db_"+g.name, g.value)
+	}
+
+	counters := []struct {
+		name, help string
+		value      float64
+	}{
+		{"wait_count_total", "Times a query waited for a free connection.", float64(stats.WaitCount)},
+		{"wait_duration_seconds_total", "Time spent waiting for a free connection.", stats.WaitDuration.Seconds()},
+		{"max_idle_closed_total", "Connections closed because of the idle limit.", float64(stats.MaxIdleClosed)},
+		{"max_idle_time_closed_total", "Connections closed because they were idle too long.", float64(stats.MaxIdleTimeClosed)},
+		{"max_lifetime_closed_total", "Connections closed because of their maximum lifetime.", float64(stats.MaxLifetimeClosed)},
+	}
+	for _, c := range counters {
+		mw.family("lightning_search_db_"+c.name, "counter", c.help)
+		mw.sample("lightning_search_db_"+c.name, c.value)
+	}
+}
+
+func (m *Metrics) writeAdmission(mw metricWriter) {
+	stats := m.governor.Stats()
+	lanes := make([]string, 0, len(stats))
+	for l := range stats {
+		lanes = append(lanes, l)
+	}
+	sort.Strings(lanes)
+
+	families := []struct {
+		name, kind, help string
+		value            func(AdmissionStats) int64
+	}{
+		{"active", "gauge", "Searches running against the database.", func(s AdmissionStats) int64 { return int64(s.Active) }},
+		{"queued", "gauge", "Searches waiting for a slot.", func(s AdmissionStats) int64 { return int64(s.Queued) }},
+		{"admitted_total", "counter", "Searches given a slot.", func(s AdmissionStats) int64 { return s.Admitted }},
+		{"rejected_total", "counter", "Searches rejected because the queue was full.", func(s AdmissionStats) int64 { return s.Rejected }},
+		{"timed_out_total", "counter", "Searches that gave up waiting in the queue.", func(s AdmissionStats) int64 { return s.TimedOut }},
+	}
+	for _, f := range families {
+		name := "lightning_search_admission_" + f.name
+		mw.family(name, f.kind, f.help)
+		for _, l := range lanes {
+			mw.sample(name, float64(f.value(stats[l])), "lane", l)
+		}
+	}
+}
+
+func (m *Metrics) writeRateLimits(mw metricWriter) {
+	stats := m.limiter.Stats()
+	routes := make([]string, 0, len(stats))
+	for route := range stats {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	families := []struct {
+		name, kind, help string
+		value            func(RateLimitStats) int64
+	}{
+		{"limit", "gauge", "Requests per minute allowed per client, 0 if unlimited.", func(s RateLimitStats) int64 { return int64(s.Limit) }},
+		{"clients", "gauge", "Clients with an active token bucket.", func(s RateLimitStats) int64 { return int64(s.Clients) }},
+		{"allowed_total", "counter", "Requests allowed by the rate limiter.", func(s RateLimitStats) int64 { return s.Allowed }},
+		{"limited_total", "counter", "Requests rejected by the rate limiter.", func(s RateLimitStats) int64 { return s.Limited }},
+	}
+	for _, f := range families {
+		name := "lightning_search_ratelimit_" + f.name
+		mw.family(name, f.kind, f.help)
+		for _, route := range routes {
+			mw.sample(name, float64(f.value(stats[route])), "route", route)
+		}
+	}
+}
+
+func (m *Metrics) writeRuntime(mw metricWriter) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	mw.family("go_goroutines", "gauge", "Number of goroutines that currently exist.")
+	mw.sample("go_goroutines", float64(runtime.NumGoroutine()))
+	mw.family("go_info", "gauge", "Information about the Go environment.")
+	mw.sample("go_info", 1, "version", runtime.Version())
+	mw.family("go_gomaxprocs", "gauge", "Number of OS threads that can run Go code at once.")
+	mw.sample("go_gomaxprocs", float64(runtime.GOMAXPROCS(0)))
+	mw.family("go_memstats_alloc_bytes", "gauge", "Bytes of allocated heap objects.")
+	mw.sample("go_memstats_alloc_bytes", float64(mem.Alloc))
+	mw.family("go_memstats_heap_inuse_bytes", "gauge", "Bytes in in-use heap spans.")
+	mw.sample("go_memstats_heap_inuse_bytes", float64(mem.HeapInuse))
+	mw.family("go_memstats_heap_objects", "gauge", "Number of allocated heap objects.")
+	mw.sample("go_memstats_heap_objects", float64(mem.HeapObjects))
+	mw.family("go_memstats_sys_bytes", "gauge", "Bytes of memory obtained from the OS.")
+	mw.sample("go_memstats_sys_bytes", float64(mem.Sys))
+	mw.family("go_memstats_mallocs_total", "counter", "Heap objects allocated.")
+	mw.sample("go_memstats_mallocs_total", float64(mem.Mallocs))
+	mw.family("go_gc_cycles_total", "counter", "Completed GC cycles.")
+	mw.sample("go_gc_cycles_total", float64(mem.NumGC))
+	mw.family("go_gc_pause_seconds_total", "counter", "Total time the GC has stopped the world.")
+	mw.sample("go_gc_pause_seconds_total", float64(mem.PauseTotalNs)/1e9)
+	mw.family("process_start_time_seconds", "gauge", "Start time of the process since the unix epoch.")
+	mw.sample("process_start_time_seconds", float64(m.started.Unix()))
+}
+
+// handleMetrics serves GET /metrics.
+func handleMetrics(metrics *Metrics) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metrics.Write(w)
+	}
+}
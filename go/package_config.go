@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// PackageConfig is the part of config/lightning-search.php the service
+// needs beyond its environment. `php artisan lightning-search:start`
+// exports it to JSON before starting the service; when the service runs
+// elsewhere the file can be copied or written by hand.
+type PackageConfig struct {
+	Keys   []APIKey               `json:"keys"`
+	CORS   CORSPolicy             `json:"cors"`
+	Tables map[string]TableConfig `json:"tables"`
+}
+
+// loadPackageConfig reads the exported config. A missing file is not an
+// error and leaves every setting at its default, as does a setting missing
+// from the file.
+func loadPackageConfig(path string) (*PackageConfig, error) {
+	pkg := &PackageConfig{CORS: defaultCORSPolicy()}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return pkg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read package config: %v", err)
+	}
+	if err := json.Unmarshal(data, pkg); err != nil {
+		return nil, fmt.Errorf("failed to parse package config %s: %v", path, err)
+	}
+	if err := pkg.CORS.validate(); err != nil {
+		return nil, fmt.Errorf("invalid package config %s: %v", path, err)
+	}
+	return pkg, nil
+}
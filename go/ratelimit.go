@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tokenBucket allows a sustained rate of requests with bursts up to its
+// capacity. It starts full.
+type tokenBucket struct {
+	rate     float64 // tokens added per second
+	capacity float64
+	tokens   float64
+	last     time.Time
+	mutex    sync.Mutex
+}
+
+// bucketState is the outcome of taking from a bucket.
+type bucketState struct {
+	Allowed    bool
+	Remaining  int
+	RetryAfter time.Duration // until the next token, when not allowed
+	Reset      time.Duration // until the bucket is full again
+}
+
+// newTokenBucket allows perMinute requests a minute, all of which may
+// arrive at once.
+func newTokenBucket(perMinute int) *tokenBucket {
+	return &tokenBucket{
+		rate:     float64(perMinute) / 60,
+		capacity: float64(perMinute),
+		tokens:   float64(perMinute),
+		last:     time.Now(),
+	}
+}
+
+// Take spends a token if one is available.
+func (b *tokenBucket) Take(now time.Time) bucketState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.refill(now)
+	state := bucketState{Allowed: b.tokens >= 1}
+	if state.Allowed {
+		b.tokens--
+	} else {
+		state.RetryAfter = b.until(1)
+	}
+	state.Remaining = int(b.tokens)
+	state.Reset = b.until(b.capacity)
+	return state
+}
+
+// Available reports whether a token could be taken, without taking it.
+func (b *tokenBucket) Available(now time.Time) (bool, time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.refill(now)
+	return b.tokens >= 1, b.until(1)
+}
+
+// idle reports whether the bucket has refilled completely, in which case
+// dropping it loses nothing.
+func (b *tokenBucket) idle(now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.refill(now)
+	return b.tokens >= b.capacity
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+}
+
+// until is how long until the bucket holds n tokens.
+func (b *tokenBucket) until(n float64) time.Duration {
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// RateLimiter keeps a token bucket per route and client. Clients are
+// identified by their API key, or by IP address when authentication is
+// off. A key's own rate limit replaces the route's default for it.
+type RateLimiter struct {
+	limits map[string]int // route to requests per minute
+
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+
+	allowed map[string]*atomic.Int64
+	limited map[string]*atomic.Int64
+}
+
+// RateLimitStats is a point-in-time view of one route's limiter.
+type RateLimitStats struct {
+	Limit   int   `json:"limit"`
+	Clients int   `json:"clients"`
+	Allowed int64 `json:"allowed"`
+	Limited int64 `json:"limited"`
+}
+
+// NewRateLimiter limits each route to the given requests per minute per
+// client; routes with a limit of 0 are only limited for keys with their
+// own rate limit.
+func NewRateLimiter(limits map[string]int) *RateLimiter {
+	l := &RateLimiter{
+		limits:  limits,
+		buckets: make(map[string]*tokenBucket),
+		allowed: make(map[string]*atomic.Int64),
+		limited: make(map[string]*atomic.Int64),
+	}
+	for route := range limits {
+		l.allowed[route] = &atomic.Int64{}
+		l.limited[route] = &atomic.Int64{}
+	}
+	go l.janitor(time.Minute)
+	return l
+}
+
+// Limit wraps a handler for route. It must run inside the authenticator so
+// the request's key is known.
+func (l *RateLimiter) Limit(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			next(w, r)
+			return
+		}
+
+		limit := l.limits[route]
+		client := "ip:" + clientIP(r)
+		if key := requestKey(r); key != nil {
+			client = "key:" + key.Name
+			if key.RateLimit > 0 {
+				limit = key.RateLimit
+			}
+		}
+		if limit <= 0 {
+			next(w, r)
+			return
+		}
+
+		state := l.bucket(route, client, limit).Take(time.Now())
+		w.Header().Set("RateLimit-Policy", strconv.Itoa(limit)+";w=60")
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(state.Remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(state.Reset)))
+		if !state.Allowed {
+			l.limited[route].Add(1)
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(state.RetryAfter)))
+			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		l.allowed[route].Add(1)
+
+		next(w, r)
+	}
+}
+
+// routeAuthFailures limits failed authentication attempts per IP address,
+// so API keys can't be guessed at full speed.
+const routeAuthFailures = "auth_failures"
+
+// Blocked answers 429 when the client's IP address has used up its
+// allowance of failed authentication attempts. It is checked before the
+// key, so a blocked client can't learn whether a guess was right.
+func (l *RateLimiter) Blocked(w http.ResponseWriter, r *http.Request) bool {
+	limit := l.limits[routeAuthFailures]
+	if limit <= 0 {
+		return false
+	}
+	available, retryAfter := l.bucket(routeAuthFailures, "ip:"+clientIP(r), limit).Available(time.Now())
+	if available {
+		return false
+	}
+	l.limited[routeAuthFailures].Add(1)
+	w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(retryAfter)))
+	http.Error(w, "Too many failed authentication attempts", http.StatusTooManyRequests)
+	return true
+}
+
+// Failed spends one of the client IP address's failed authentication
+// attempts.
+func (l *RateLimiter) Failed(r *http.Request) {
+	limit := l.limits[routeAuthFailures]
+	if limit <= 0 {
+		return
+	}
+	l.bucket(routeAuthFailures, "ip:"+clientIP(r), limit).Take(time.Now())
+	l.allowed[routeAuthFailures].Add(1)
+}
+
+func (l *RateLimiter) bucket(route, client string, limit int) *tokenBucket {
+	id := route + "|" + client + "|" + strconv.Itoa(limit)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	bucket, found := l.buckets[id]
+	if !found {
+		bucket = newTokenBucket(limit)
+		l.buckets[id] = bucket
+	}
+	return bucket
+}
+
+func (l *RateLimiter) Stats() map[string]RateLimitStats {
+	l.mutex.Lock()
+	clients := make(map[string]int, len(l.limits))
+	for id := range l.buckets {
+		for route := range l.limits {
+			if strings.HasPrefix(id, route+"|") {
+				clients[route]++
+			}
+		}
+	}
+	l.mutex.Unlock()
+
+	stats := make(map[string]RateLimitStats, len(l.limits))
+	for route, limit := range l.limits {
+		stats[route] = RateLimitStats{
+			Limit:   limit,
+			Clients: clients[route],
+			Allowed: l.allowed[route].Load(),
+			Limited: l.limited[route].Load(),
+		}
+	}
+	return stats
+}
+
+// janitor drops buckets that have refilled, so clients seen once don't
+// stay in memory.
+func (l *RateLimiter) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		l.mutex.Lock()
+		for id, bucket := range l.buckets {
+			if bucket.idle(now) {
+				delete(l.buckets, id)
+			}
+		}
+		l.mutex.Unlock()
+	}
+}
+
+// clientIP is the address the request came from. Forwarding headers are
+// ignored, since any client could set them.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// handleRateLimitStats serves GET /ratelimit/stats.
+func handleRateLimitStats(limiter *RateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(limiter.Stats())
+	}
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Payloads at least this large are gzipped before they are sent to Redis.
+const redisCompressThreshold = 1024
+
+// Stored values start with a byte saying how the rest is encoded.
+const (
+	redisEncodingJSON byte = iota
+	redisEncodingGzip
+)
+
+// RedisCache stores search results in any server speaking the Redis
+// protocol (Redis, Valkey, KeyDB, or a stand-in in tests), so every
+// service instance behind a load balancer shares the same entries.
+//
+// Each entry lives at <prefix>cache:<key> with a TTL covering its fresh
+// and grace periods. Tags are sets at <prefix>tag:<tag> listing the keys
+// that carry them.
+type RedisCache struct {
+	client *redisClient
+	prefix string
+
+	hits          atomic.Int64
+	staleHits     atomic.Int64
+	misses        atomic.Int64
+	invalidations atomic.Int64
+}
+
+// redisEntry is the stored form of a cached result.
+type redisEntry struct {
+	Value      CachedResult `json:"value"`
+	FreshUntil int64        `json:"fresh_until"` // unix milliseconds
+}
+
+// NewRedisCache connects to the server at rawURL, e.g.
+// redis://:password@127.0.0.1:6379/0, and namespaces keys with prefix.
+func NewRedisCache(rawURL, prefix string, poolSize int, timeout time.Duration) (*RedisCache, error) {
+	client, err := newRedisClient(rawURL, poolSize, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisCache{client: client, prefix: prefix}, nil
+}
+
+func (c *RedisCache) entryKey(key string) string {
+	return c.prefix + "cache:" + key
+}
+
+func (c *RedisCache) tagKey(tag string) string {
+	return c.prefix + "tag:" + tag
+}
+
+// Ping checks the server is reachable.
+func (c *RedisCache) Ping() error {
+	_, err := c.client.Do("PING")
+	return err
+}
+
+func (c *RedisCache) GetStale(key string) (CachedResult, bool, bool, error) {
+	reply, err := c.client.Do("GET", c.entryKey(key))
+	if err != nil {
+		return CachedResult{}, false, false, err
+	}
+	data, ok := reply.([]byte)
+	if !ok || len(data) == 0 {
+		c.misses.Add(1)
+		return CachedResult{}, false, false, nil
+	}
+
+	entry, err := decodeRedisEntry(data)
+	if err != nil {
+		// Unreadable entries, e.g. from an older version, are misses
+		c.misses.Add(1)
+		return CachedResult{}, false, false, nil
+	}
+
+	if time.Now().UnixMilli() >= entry.FreshUntil {
+		c.staleHits.Add(1)
+		return entry.Value, true, true, nil
+	}
+	c.hits.Add(1)
+	return entry.Value, false, true, nil
+}
+
+func (c *RedisCache) Set(key string, value CachedResult, duration, grace time.Duration, tags ...string) error {
+	data, err := encodeRedisEntry(redisEntry{
+		Value:      value,
+		FreshUntil: time.Now().Add(duration).UnixMilli(),
+	})
+	if err != nil {
+		return err
+	}
+
+	ttl := strconv.FormatInt((duration + grace).Milliseconds(), 10)
+	entryKey := c.entryKey(key)
+
+	commands := [][]interface{}{{"SET", entryKey, data, "PX", ttl}}
+	for _, tag := range tags {
+		tagKey := c.tagKey(tag)
+		commands = append(commands,
+			[]interface{}{"SADD", tagKey, entryKey},
+			[]interface{}{"PEXPIRE", tagKey, ttl},
+		)
+	}
+	replies, err := c.client.Pipeline(commands)
+	if err != nil {
+		return err
+	}
+	// A full or read-only server answers each command with an error
+	// reply rather than failing the pipeline
+	for _, reply := range replies {
+		if e, ok := reply.(redisError); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+func (c *RedisCache) InvalidateTag(tag string) (int, error) {
+	tagKey := c.tagKey(tag)
+	reply, err := c.client.Do("SMEMBERS", tagKey)
+	if err != nil {
+		return 0, err
+	}
+	members, _ := reply.([]interface{})
+
+	keys := make([]interface{}, 0, len(members)+2)
+	keys = append(keys, "DEL", tagKey)
+	for _, member := range members {
+		keys = append(keys, member)
+	}
+	if _, err := c.client.Do(keys...); err != nil {
+		return 0, err
+	}
+
+	c.invalidations.Add(int64(len(members)))
+	return len(members), nil
+}
+
+// InvalidatePrefix walks the keyspace with SCAN, which never blocks the
+// server the way KEYS would.
+func (c *RedisCache) InvalidatePrefix(prefix string) (int, error) {
+	pattern := redisGlobEscape(c.entryKey(prefix)) + "*"
+	cursor := "0"
+	removed := 0
+
+	for {
+		reply, err := c.client.Do("SCAN", cursor, "MATCH", pattern, "COUNT", "500")
+		if err != nil {
+			return removed, err
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 2 {
+			return removed, errors.New("unexpected SCAN reply")
+		}
+		next, _ := parts[0].([]byte)
+		keys, _ := parts[1].([]interface{})
+
+		if len(keys) > 0 {
+			args := append([]interface{}{"DEL"}, keys...)
+			n, err := c.client.Do(args...)
+			if err != nil {
+				return removed, err
+			}
+			if deleted, ok := n.(int64); ok {
+				removed += int(deleted)
+			}
+		}
+
+		cursor = string(next)
+		if cursor == "0" || cursor == "" {
+			break
+		}
+	}
+
+	c.invalidations.Add(int64(removed))
+	return removed, nil
+}
+
+// Stats reports this instance's view of the shared cache. Entry counts
+// and sizes live in Redis and are not tracked here.
+func (c *RedisCache) Stats() CacheStats {
+	return CacheStats{
+		Backend:       "redis",
+		Hits:          c.hits.Load(),
+		StaleHits:     c.staleHits.Load(),
+		Misses:        c.misses.Load(),
+		Invalidations: c.invalidations.Load(),
+	}
+}
+
+func (c *RedisCache) Close() {
+	c.client.Close()
+}
+
+func encodeRedisEntry(entry redisEntry) ([]byte, error) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < redisCompressThreshold {
+		return append([]byte{redisEncodingJSON}, data...), nil
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(redisEncodingGzip)
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeRedisEntry(data []byte) (redisEntry, error) {
+	var entry redisEntry
+	payload := data[1:]
+
+	switch data[0] {
+	case redisEncodingJSON:
+	case redisEncodingGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return entry, err
+		}
+		defer zr.Close()
+		if payload, err = io.ReadAll(zr); err != nil {
+			return entry, err
+		}
+	default:
+		return entry, fmt.Errorf("unknown cache entry encoding %d", data[0])
+	}
+
+	// Numbers stay json.Number so large integer IDs are not turned into
+	// floats, which would print as 1.234567e+06
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	err := decoder.Decode(&entry)
+	return entry, err
+}
+
+// redisGlobEscape escapes the characters SCAN MATCH treats as wildcards.
+func redisGlobEscape(s string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+	return replacer.Replace(s)
+}
+
+// redisClient is a minimal RESP2 client with a fixed-size connection pool.
+// It only needs the handful of commands the cache uses, so it avoids
+// pulling in a Redis library.
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+	pool     chan *redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// redisError is an error reply from the server. The connection is still
+// usable after one.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func newRedisClient(rawURL string, poolSize int, timeout time.Duration) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %v", err)
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("unsupported redis url scheme %q", u.Scheme)
+	}
+
+	client := &redisClient{
+		addr:    u.Host,
+		timeout: timeout,
+		pool:    make(chan *redisConn, poolSize),
+	}
+	if !strings.Contains(client.addr, ":") {
+		client.addr += ":6379"
+	}
+	if password, ok := u.User.Password(); ok {
+		client.password = password
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if client.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+	}
+	return client, nil
+}
+
+func (c *redisClient) Do(args ...interface{}) (interface{}, error) {
+	replies, err := c.Pipeline([][]interface{}{args})
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := replies[0].(redisError); ok {
+		return nil, e
+	}
+	return replies[0], nil
+}
+
+// Pipeline sends every command before reading any reply. Error replies are
+// returned in place as redisError values.
+func (c *redisClient) Pipeline(commands [][]interface{}) ([]interface{}, error) {
+	conn, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+
+	conn.conn.SetDeadline(time.Now().Add(c.timeout))
+	replies, err := conn.pipeline(commands)
+	if err != nil {
+		conn.conn.Close()
+		return nil, err
+	}
+	c.put(conn)
+	return replies, nil
+}
+
+func (c *redisClient) get() (*redisConn, error) {
+	select {
+	case conn := <-c.pool:
+		return conn, nil
+	default:
+	}
+
+	netConn, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{
+		conn: netConn,
+		r:    bufio.NewReader(netConn),
+		w:    bufio.NewWriter(netConn),
+	}
+
+	var setup [][]interface{}
+	if c.password != "" {
+		setup = append(setup, []interface{}{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		setup = append(setup, []interface{}{"SELECT", strconv.Itoa(c.db)})
+	}
+	if len(setup) > 0 {
+		netConn.SetDeadline(time.Now().Add(c.timeout))
+		replies, err := conn.pipeline(setup)
+		if err == nil {
+			for _, reply := range replies {
+				if e, ok := reply.(redisError); ok {
+					err = e
+				}
+			}
+		}
+		if err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c *redisClient) put(conn *redisConn) {
+	select {
+	case c.pool <- conn:
+	default:
+		conn.conn.Close()
+	}
+}
+
+func (c *redisClient) Close() {
+	for {
+		select {
+		case conn := <-c.pool:
+			conn.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+func (conn *redisConn) pipeline(commands [][]interface{}) ([]interface{}, error) {
+	for _, args := range commands {
+		fmt.Fprintf(conn.w, "*%d\r\n", len(args))
+		for _, arg := range args {
+			var b []byte
+			switch v := arg.(type) {
+			case []byte:
+				b = v
+			case string:
+				b = []byte(v)
+			default:
+				b = []byte(fmt.Sprint(v))
+			}
+			fmt.Fprintf(conn.w, "$%d\r\n", len(b))
+			conn.w.Write(b)
+			conn.w.WriteString("\r\n")
+		}
+	}
+	if err := conn.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	replies := make([]interface{}, len(commands))
+	for i := range commands {
+		reply, err := conn.readReply()
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+func (conn *redisConn) readLine() (string, error) {
+	line, err := conn.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\r\n"), nil
+}
+
+// readReply parses one RESP2 reply. Bulk strings come back as []byte,
+// integers as int64, arrays as []interface{} and nil replies as nil.
+func (conn *redisConn) readReply() (interface{}, error) {
+	line, err := conn.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return redisError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(conn.r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = conn.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-process stand-in speaking just enough RESP2 for
+// RedisCache: strings with PX expiry, sets, DEL and a paged SCAN.
+type fakeRedis struct {
+	listener net.Listener
+
+	mutex   sync.Mutex
+	strings map[string][]byte
+	sets    map[string]map[string]bool
+	expires map[string]time.Time
+	conns   map[net.Conn]bool
+	// cursors maps a SCAN cursor to the last key returned before it
+	cursors map[string]string
+	// readOnly answers writes with an error reply, like a replica
+	readOnly bool
+}
+
+func startFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{
+		listener: listener,
+		strings:  make(map[string][]byte),
+		sets:     make(map[string]map[string]bool),
+		expires:  make(map[string]time.Time),
+		conns:    make(map[net.Conn]bool),
+		cursors:  make(map[string]string),
+	}
+	go f.serve()
+	t.Cleanup(f.stop)
+	return f
+}
+
+func (f *fakeRedis) url() string {
+	return "redis://" + f.listener.Addr().String()
+}
+
+func (f *fakeRedis) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		f.mutex.Lock()
+		f.conns[conn] = true
+		f.mutex.Unlock()
+		go f.handle(conn)
+	}
+}
+
+// stop closes the listener and every open connection, as a server going
+// down would.
+func (f *fakeRedis) stop() {
+	f.listener.Close()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for conn := range f.conns {
+		conn.Close()
+	}
+}
+
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		f.mutex.Lock()
+		f.execute(w, args)
+		f.mutex.Unlock()
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || line[0] != '*' {
+		return nil, fmt.Errorf("bad command %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:size])
+	}
+	return args, nil
+}
+
+func (f *fakeRedis) expire(key string) {
+	if at, ok := f.expires[key]; ok && time.Now().After(at) {
+		delete(f.strings, key)
+		delete(f.sets, key)
+		delete(f.expires, key)
+	}
+}
+
+func (f *fakeRedis) setReadOnly(readOnly bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.readOnly = readOnly
+}
+
+func (f *fakeRedis) execute(w *bufio.Writer, args []string) {
+	command := strings.ToUpper(args[0])
+	if f.readOnly && (command == "SET" || command == "SADD" || command == "PEXPIRE" || command == "DEL") {
+		w.WriteString("-READONLY You can't write against a read only replica.\r\n")
+		return
+	}
+
+	switch command {
+	case "PING":
+		w.WriteString("+PONG\r\n")
+	case "GET":
+		f.expire(args[1])
+		if value, ok := f.strings[args[1]]; ok {
+			fmt.Fprintf(w, "$%d\r\n%s\r\n", len(value), value)
+		} else {
+			w.WriteString("$-1\r\n")
+		}
+	case "SET":
+		f.strings[args[1]] = []byte(args[2])
+		delete(f.expires, args[1])
+		if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+			ms, _ := strconv.Atoi(args[4])
+			f.expires[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		w.WriteString("+OK\r\n")
+	case "SADD":
+		set, ok := f.sets[args[1]]
+		if !ok {
+			set = make(map[string]bool)
+			f.sets[args[1]] = set
+		}
+		for _, member := range args[2:] {
+			set[member] = true
+		}
+		fmt.Fprintf(w, ":%d\r\n", len(args)-2)
+	case "PEXPIRE":
+		ms, _ := strconv.Atoi(args[2])
+		f.expires[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		w.WriteString(":1\r\n")
+	case "SMEMBERS":
+		f.expire(args[1])
+		set := f.sets[args[1]]
+		fmt.Fprintf(w, "*%d\r\n", len(set))
+		for member := range set {
+			fmt.Fprintf(w, "$%d\r\n%s\r\n", len(member), member)
+		}
+	case "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			f.expire(key)
+			_, isString := f.strings[key]
+			_, isSet := f.sets[key]
+			if isString || isSet {
+				deleted++
+			}
+			delete(f.strings, key)
+			delete(f.sets, key)
+			delete(f.expires, key)
+		}
+		fmt.Fprintf(w, ":%d\r\n", deleted)
+	case "SCAN":
+		// Pages of two keys, so callers have to follow the cursor. Like
+		// Redis, keys deleted between pages don't make SCAN skip others.
+		after := f.cursors[args[1]]
+		pattern := "*"
+		for i := 2; i+1 < len(args); i += 2 {
+			if strings.ToUpper(args[i]) == "MATCH" {
+				pattern = args[i+1]
+			}
+		}
+		var keys []string
+		for key := range f.strings {
+			if key > after {
+				keys = append(keys, key)
+			}
+		}
+		for key := range f.sets {
+			if key > after {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		next := "0"
+		if len(keys) > 2 {
+			keys = keys[:2]
+			next = strconv.Itoa(len(f.cursors) + 1)
+			f.cursors[next] = keys[1]
+		}
+		var matched []string
+		for _, key := range keys {
+			if ok, _ := path.Match(pattern, key); ok {
+				matched = append(matched, key)
+			}
+		}
+		fmt.Fprintf(w, "*2\r\n$%d\r\n%s\r\n*%d\r\n", len(next), next, len(matched))
+		for _, key := range matched {
+			fmt.Fprintf(w, "$%d\r\n%s\r\n", len(key), key)
+		}
+	default:
+		fmt.Fprintf(w, "-ERR unknown command '%s'\r\n", args[0])
+	}
+}
+
+func newTestRedisCache(t *testing.T, server *fakeRedis) *RedisCache {
+	t.Helper()
+	cache, err := NewRedisCache(server.url(), "test:", 2, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cache.Close)
+	return cache
+}
+
+func TestRedisCacheRoundTrip(t *testing.T) {
+	server := startFakeRedis(t)
+	cache := newTestRedisCache(t, server)
+
+	value := CachedResult{
+		Results:  []map[string]interface{}{{"id": int64(1234567), "name": "Acme"}},
+		Count:    1,
+		Strategy: strategyFulltext,
+	}
+	if err := cache.Set("companies:acme:auto", value, time.Minute, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	got, stale, found, err := cache.GetStale("companies:acme:auto")
+	if err != nil || !found || stale {
+		t.Fatalf("GetStale = found %v, stale %v, err %v; want a fresh hit", found, stale, err)
+	}
+	if got.Count != 1 || got.Strategy != strategyFulltext || got.Results[0]["name"] != "Acme" {
+		t.Errorf("GetStale returned %+v", got)
+	}
+	// Large IDs must not come back as floats, or rules and tags stop
+	// matching them
+	if id := fmt.Sprint(got.Results[0]["id"]); id != "1234567" {
+		t.Errorf("id = %q, want 1234567", id)
+	}
+
+	if _, _, found, _ := cache.GetStale("companies:other:auto"); found {
+		t.Error("GetStale found a key that was never set")
+	}
+}
+
+func TestRedisCacheCompressesLargeEntries(t *testing.T) {
+	server := startFakeRedis(t)
+	cache := newTestRedisCache(t, server)
+
+	var results []map[string]interface{}
+	for i := 0; i < 100; i++ {
+		results = append(results, map[string]interface{}{"id": int64(i), "name": fmt.Sprintf("Company %d", i)})
+	}
+	if err := cache.Set("companies:company:auto", CachedResult{Results: results, Count: len(results)}, time.Minute, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	server.mutex.Lock()
+	stored := server.strings["test:cache:companies:company:auto"]
+	server.mutex.Unlock()
+	if len(stored) == 0 || stored[0] != redisEncodingGzip {
+		t.Fatalf("entry above %d bytes was not gzipped", redisCompressThreshold)
+	}
+
+	got, _, found, err := cache.GetStale("companies:company:auto")
+	if err != nil || !found {
+		t.Fatalf("GetStale = found %v, err %v", found, err)
+	}
+	if got.Count != 100 || fmt.Sprint(got.Results[99]["id"]) != "99" || got.Results[99]["name"] != "Company 99" {
+		t.Errorf("compressed entry did not round-trip: count %d, last %v", got.Count, got.Results[99])
+	}
+}
+
+func TestRedisCacheStaleEntries(t *testing.T) {
+	server := startFakeRedis(t)
+	cache := newTestRedisCache(t, server)
+
+	// No fresh period, only grace: served, but stale
+	if err := cache.Set("companies:acme:like", CachedResult{Count: 1}, 0, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, stale, found, _ := cache.GetStale("companies:acme:like"); !found || !stale {
+		t.Errorf("GetStale = found %v, stale %v; want a stale hit", found, stale)
+	}
+
+	stats := cache.Stats()
+	if stats.StaleHits != 1 || stats.Hits != 0 {
+		t.Errorf("stats = %+v, want one stale hit", stats)
+	}
+}
+
+func TestRedisCacheInvalidateTag(t *testing.T) {
+	server := startFakeRedis(t)
+	cache := newTestRedisCache(t, server)
+
+	cache.Set("companies:acme:auto", CachedResult{}, time.Minute, 0, tableTag("companies"), documentTag("companies", "1"))
+	cache.Set("companies:beta:auto", CachedResult{}, time.Minute, 0, tableTag("companies"), documentTag("companies", "2"))
+
+	removed, err := cache.InvalidateTag(documentTag("companies", "1"))
+	if err != nil || removed != 1 {
+		t.Fatalf("InvalidateTag = %d, %v; want 1", removed, err)
+	}
+	if _, _, found, _ := cache.GetStale("companies:acme:auto"); found {
+		t.Error("entry tagged with the document survived invalidation")
+	}
+	if _, _, found, _ := cache.GetStale("companies:beta:auto"); !found {
+		t.Error("entry without the document was invalidated")
+	}
+}
+
+func TestRedisCacheInvalidatePrefix(t *testing.T) {
+	server := startFakeRedis(t)
+	cache := newTestRedisCache(t, server)
+
+	keys := []string{"companies:acme:auto", "companies:acme:like", "companies:acme corp:auto", "companies:beta:auto", "people:acme:auto"}
+	for _, key := range keys {
+		cache.Set(key, CachedResult{}, time.Minute, 0)
+	}
+
+	// Several SCAN pages, and the prefix holds a glob character
+	cache.Set("companies:ac*:auto", CachedResult{}, time.Minute, 0)
+	removed, err := cache.InvalidatePrefix("companies:acme")
+	if err != nil || removed != 3 {
+		t.Fatalf("InvalidatePrefix = %d, %v; want 3", removed, err)
+	}
+	for key, want := range map[string]bool{
+		"companies:acme:auto":      false,
+		"companies:acme corp:auto": false,
+		"companies:beta:auto":      true,
+		"people:acme:auto":         true,
+		"companies:ac*:auto":       true,
+	} {
+		if _, _, found, _ := cache.GetStale(key); found != want {
+			t.Errorf("%s found = %v, want %v", key, found, want)
+		}
+	}
+
+	if removed, _ := cache.InvalidatePrefix("companies:ac*"); removed != 1 {
+		t.Errorf("InvalidatePrefix with a literal * removed %d, want 1", removed)
+	}
+}
+
+func TestRedisCacheSetReportsErrorReplies(t *testing.T) {
+	server := startFakeRedis(t)
+	shared := newTestRedisCache(t, server)
+	local := NewCache[CachedResult](1<<20, time.Minute, estimateResultSize)
+	cache := newFallbackCache(shared, local, time.Minute)
+	defer local.Close()
+
+	server.setReadOnly(true)
+	if err := shared.Set("companies:acme:auto", CachedResult{Count: 1}, time.Minute, 0, tableTag("companies")); err == nil {
+		t.Fatal("Set succeeded against a read-only server")
+	}
+
+	cache.Set("companies:acme:auto", CachedResult{Count: 1}, time.Minute, 0, tableTag("companies"))
+	if local.Stats().Entries != 1 {
+		t.Error("entry rejected by the server did not go to the local cache")
+	}
+	if cache.Stats().SharedAvailable {
+		t.Error("shared cache still reported available after an error reply")
+	}
+}
+
+func TestFallbackCacheUsesLocalWhenServerIsDown(t *testing.T) {
+	server := startFakeRedis(t)
+	shared := newTestRedisCache(t, server)
+	local := NewCache[CachedResult](1<<20, time.Minute, estimateResultSize)
+	cache := newFallbackCache(shared, local, time.Minute)
+	defer local.Close()
+
+	cache.Set("companies:acme:auto", CachedResult{Count: 1}, time.Minute, 0)
+	if local.Stats().Entries != 0 {
+		t.Fatal("entry went to the local cache while the server was up")
+	}
+	if !cache.Stats().SharedAvailable {
+		t.Error("shared cache reported unavailable while the server was up")
+	}
+
+	server.stop()
+
+	cache.Set("companies:beta:auto", CachedResult{Count: 2}, time.Minute, 0, tableTag("companies"))
+	if cache.Stats().SharedAvailable {
+		t.Error("shared cache still reported available after a failure")
+	}
+	got, _, found := cache.GetStale("companies:beta:auto")
+	if !found || got.Count != 2 {
+		t.Fatalf("GetStale = %+v, %v; want the locally cached entry", got, found)
+	}
+
+	if removed, err := cache.InvalidateTag(tableTag("companies")); removed != 1 || err == nil {
+		t.Errorf("InvalidateTag = %d, %v while the server was down; want 1 and an error", removed, err)
+	}
+	if _, _, found := cache.GetStale("companies:beta:auto"); found {
+		t.Error("local entry survived invalidation")
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rule pins or hides specific records for queries matching Pattern.
+// Pattern is compared against the normalized query and may contain "*"
+// wildcards, so "acme*" matches "acme" and "acme holdings".
+type Rule struct {
+	ID       string     `json:"id"`
+	Table    string     `json:"table,omitempty"` // empty applies to every table
+	Pattern  string     `json:"pattern"`
+	Pinned   []string   `json:"pinned,omitempty"`
+	Excluded []string   `json:"excluded,omitempty"`
+	StartsAt *time.Time `json:"starts_at,omitempty"`
+	EndsAt   *time.Time `json:"ends_at,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// Active reports whether the rule is inside its scheduling window.
+func (r Rule) Active(now time.Time) bool {
+	if r.StartsAt != nil && now.Before(*r.StartsAt) {
+		return false
+	}
+	if r.EndsAt != nil && !now.Before(*r.EndsAt) {
+		return false
+	}
+	return true
+}
+
+// Matches reports whether the rule applies to a query against table.
+func (r Rule) Matches(table, query string) bool {
+	if r.Table != "" && r.Table != table {
+		return false
+	}
+	re := r.re
+	if re == nil {
+		re = patternRegexp(r.Pattern)
+	}
+	return re.MatchString(normalizeRuleQuery(query))
+}
+
+func (r Rule) validate() error {
+	if strings.TrimSpace(r.Pattern) == "" {
+		return fmt.Errorf("pattern is required")
+	}
+	if len(r.Pinned) == 0 && len(r.Excluded) == 0 {
+		return fmt.Errorf("at least one pinned or excluded id is required")
+	}
+	if r.StartsAt != nil && r.EndsAt != nil && !r.EndsAt.After(*r.StartsAt) {
+		return fmt.Errorf("ends_at must be after starts_at")
+	}
+	return nil
+}
+
+func normalizeRuleQuery(q string) string {
+	return strings.Join(strings.Fields(strings.ToLower(q)), " ")
+}
+
+func patternRegexp(pattern string) *regexp.Regexp {
+	parts := strings.Split(normalizeRuleQuery(pattern), "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+}
+
+// RuleStore keeps merchandising rules in memory and persists every change
+// to a JSON file so they survive restarts.
+type RuleStore struct {
+	path  string
+	rules []Rule
+	mutex sync.RWMutex
+}
+
+func NewRuleStore(path string) (*RuleStore, error) {
+	store := &RuleStore{path: path}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules file: %v", err)
+	}
+	if err := json.Unmarshal(data, &store.rules); err != nil {
+		return nil, fmt.Errorf("failed to parse rules file %s: %v", path, err)
+	}
+	for i := range store.rules {
+		store.rules[i].re = patternRegexp(store.rules[i].Pattern)
+	}
+	return store, nil
+}
+
+// errRuleForbidden is returned when a caller touches a rule on a table it
+// may not access.
+var errRuleForbidden = errors.New("API key is not allowed to access this table")
+
+func (s *RuleStore) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.rules)
+}
+
+// List returns the rules on tables allows accepts.
+func (s *RuleStore) List(allows func(table string) bool) []Rule {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	rules := make([]Rule, 0, len(s.rules))
+	for _, rule := range s.rules {
+		if allows(rule.Table) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// Put creates a rule, or replaces the rule with the same ID. Both the new
+// rule's table and, when replacing, the old rule's table must be allowed.
+func (s *RuleStore) Put(rule Rule, allows func(table string) bool) (Rule, error) {
+	if err := rule.validate(); err != nil {
+		return rule, err
+	}
+	if rule.ID == "" {
+		rule.ID = newRuleID()
+	}
+	rule.re = patternRegexp(rule.Pattern)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !allows(rule.Table) {
+		return rule, errRuleForbidden
+	}
+	rules := append([]Rule{}, s.rules...)
+	replaced := false
+	for i := range rules {
+		if rules[i].ID == rule.ID {
+			if !allows(rules[i].Table) {
+				return rule, errRuleForbidden
+			}
+			rules[i] = rule
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		rules = append(rules, rule)
+	}
+
+	if err := s.save(rules); err != nil {
+		return rule, err
+	}
+	s.rules = rules
+	return rule, nil
+}
+
+// Delete removes a rule on a table allows accepts, and reports whether it
+// existed.
+func (s *RuleStore) Delete(id string, allows func(table string) bool) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	rules := make([]Rule, 0, len(s.rules))
+	for _, rule := range s.rules {
+		if rule.ID != id {
+			rules = append(rules, rule)
+		} else if !allows(rule.Table) {
+			return false, errRuleForbidden
+		}
+	}
+	if len(rules) == len(s.rules) {
+		return false, nil
+	}
+
+	if err := s.save(rules); err != nil {
+		return false, err
+	}
+	s.rules = rules
+	return true, nil
+}
+
+// Match returns the active rules for a query, in the order they were added.
+func (s *RuleStore) Match(table, query string, now time.Time) []Rule {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var matched []Rule
+	for _, rule := range s.rules {
+		if rule.Active(now) && rule.Matches(table, query) {
+			matched = append(matched, rule)
+		}
+	}
+	return matched
+}
+
+// save writes the rules to a temporary file and renames it into place so a
+// crash never leaves a half-written rules file behind.
+func (s *RuleStore) save(rules []Rule) error {
+	data, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("failed to create rules directory: %v", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write rules file: %v", err)
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func newRuleID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// RuleAdjustment records how a rule moved or removed a single record.
+// Position is the record's 1-based rank before rules were applied, or 0
+// when a pinned record had to be fetched because the search missed it.
+type RuleAdjustment struct {
+	ID       string `json:"id"`
+	RuleID   string `json:"rule_id"`
+	Action   string `json:"action"` // "pinned" or "excluded"
+	Position int    `json:"position"`
+}
+
+// applyRules reorders ranked results so pinned records come first, in the
+// order they were pinned, and drops excluded records. Pinned records that
+// the search did not return are loaded with fetch. Exclusion wins when a
+// record is both pinned and excluded.
+func applyRules(rules []Rule, keyField string, results []map[string]interface{}, fetch func(ids []string) ([]map[string]interface{}, error)) ([]map[string]interface{}, []RuleAdjustment, error) {
+	if len(rules) == 0 {
+		return results, nil, nil
+	}
+
+	excluded := make(map[string]string)
+	for _, rule := range rules {
+		for _, id := range rule.Excluded {
+			if _, ok := excluded[id]; !ok {
+				excluded[id] = rule.ID
+			}
+		}
+	}
+
+	var pinned []string
+	pinnedBy := make(map[string]string)
+	for _, rule := range rules {
+		for _, id := range rule.Pinned {
+			if _, ok := excluded[id]; ok {
+				continue
+			}
+			if _, ok := pinnedBy[id]; !ok {
+				pinnedBy[id] = rule.ID
+				pinned = append(pinned, id)
+			}
+		}
+	}
+
+	var adjustments []RuleAdjustment
+	positions := make(map[string]int, len(pinned))
+	byID := make(map[string]map[string]interface{}, len(pinned))
+	rest := make([]map[string]interface{}, 0, len(results))
+	for i, row := range results {
+		id := rowID(row[keyField])
+		if ruleID, ok := excluded[id]; ok {
+			adjustments = append(adjustments, RuleAdjustment{ID: id, RuleID: ruleID, Action: "excluded", Position: i + 1})
+			continue
+		}
+		if _, ok := pinnedBy[id]; ok {
+			byID[id] = row
+			positions[id] = i + 1
+			continue
+		}
+		rest = append(rest, row)
+	}
+
+	var missing []string
+	for _, id := range pinned {
+		if _, ok := byID[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 && fetch != nil {
+		rows, err := fetch(missing)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, row := range rows {
+			byID[rowID(row[keyField])] = row
+		}
+	}
+
+	final := make([]map[string]interface{}, 0, len(pinned)+len(rest))
+	for _, id := range pinned {
+		if row, ok := byID[id]; ok {
+			final = append(final, row)
+			adjustments = append(adjustments, RuleAdjustment{ID: id, RuleID: pinnedBy[id], Action: "pinned", Position: positions[id]})
+		}
+	}
+	return append(final, rest...), adjustments, nil
+}
+
+// rowID formats a primary key value the same way whichever type it was
+// decoded as: int64 from MySQL, json.Number or float64 from a cache.
+func rowID(value interface{}) string {
+	switch v := value.(type) {
+	case json.Number:
+		return v.String()
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return strconv.FormatInt(int64(v), 10)
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// handleRules serves the admin API for merchandising rules:
+//
+//	GET    /admin/rules          list rules
+//	POST   /admin/rules          create or replace a rule
+//	DELETE /admin/rules?id=<id>  delete a rule
+func handleRules(store *RuleStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		allows := requestKey(r).AllowsTable
+
+		switch r.Method {
+		case "GET":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"rules": store.List(allows),
+			})
+		case "POST":
+			var rule Rule
+			if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+				http.Error(w, "Error parsing request JSON", http.StatusBadRequest)
+				return
+			}
+			if err := rule.validate(); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid rule: %v", err), http.StatusBadRequest)
+				return
+			}
+			saved, err := store.Put(rule, allows)
+			if errors.Is(err, errRuleForbidden) {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error saving rule: %v", err), http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(saved)
+		case "DELETE":
+			id := r.URL.Query().Get("id")
+			if id == "" {
+				http.Error(w, "Missing rule id", http.StatusBadRequest)
+				return
+			}
+			deleted, err := store.Delete(id, allows)
+			if errors.Is(err, errRuleForbidden) {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error deleting rule: %v", err), http.StatusInternalServerError)
+				return
+			}
+			if !deleted {
+				http.Error(w, "Rule not found", http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"deleted": id,
+			})
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SearchScope restricts a search to the rows its caller may see. It is
+// part of the cache key, and its predicates are added to every query, so
+// results are never shared or leaked across scopes.
+type SearchScope struct {
+	Tenant string `json:"tenant,omitempty"`
+	// Constraints maps a column to the values it may hold, for example the
+	// regions a user may see. Values are kept sorted so equal constraints
+	// always produce the same cache key.
+	Constraints map[string][]string `json:"constraints,omitempty"`
+}
+
+var (
+	errTenantRequired = errors.New("table is tenant-scoped but no tenant was given")
+	errTableNotScoped = errors.New("table is not in the package config, so scoped searches can't be enforced on it")
+)
+
+// IsZero reports whether the scope allows every row.
+func (s SearchScope) IsZero() bool {
+	return s.Tenant == "" && len(s.Constraints) == 0
+}
+
+// resolveScope works out the scope for a search on tableConfig. The tenant
+// comes from the API key when the key is bound to one, and otherwise from
+// signed claims; a key bound to a tenant can't be used for another.
+// Constraints only ever come from signed claims. Scoped callers may only
+// search exported tables, since only those say which columns to scope on.
+func resolveScope(tableConfig *TableConfig, key *APIKey, claims *Claims) (SearchScope, error) {
+	var scope SearchScope
+	if !tableConfig.Exported && ((key != nil && key.Tenant != "") || claims != nil) {
+		return scope, errTableNotScoped
+	}
+	if claims != nil && len(claims.Constraints) > 0 {
+		scope.Constraints = make(map[string][]string, len(claims.Constraints))
+		for column, values := range claims.Constraints {
+			values = append([]string{}, values...)
+			sort.Strings(values)
+			scope.Constraints[column] = values
+		}
+	}
+	if tableConfig.TenantColumn != "" {
+		if key != nil && key.Tenant != "" {
+			scope.Tenant = key.Tenant
+			if claims != nil && claims.Tenant != "" && claims.Tenant != key.Tenant {
+				return scope, fmt.Errorf("claims tenant does not match the API key's tenant")
+			}
+		} else if claims != nil {
+			scope.Tenant = claims.Tenant
+		}
+	}
+	return scope, scope.validate(tableConfig)
+}
+
+// validate checks the scope can be enforced on tableConfig: a tenant-scoped
+// table needs a tenant, and every constrained column must be one the table
+// allows constraints on. Columns end up in SQL, so nothing else may be
+// used, and a constraint that can't be applied must not be silently
+// dropped.
+func (s SearchScope) validate(tableConfig *TableConfig) error {
+	if !tableConfig.Exported && !s.IsZero() {
+		return errTableNotScoped
+	}
+	if tableConfig.TenantColumn != "" && s.Tenant == "" {
+		return errTenantRequired
+	}
+	for column := range s.Constraints {
+		allowed := false
+		for _, c := range tableConfig.ConstraintColumns {
+			if c == column {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("table %s does not allow constraints on %q", tableConfig.Name, column)
+		}
+	}
+	return nil
+}
+
+// predicates returns the SQL conditions enforcing the scope, each to be
+// ANDed into a WHERE clause, and their arguments.
+func (s SearchScope) predicates(tableConfig *TableConfig) ([]string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	if tableConfig.TenantColumn != "" {
+		conditions = append(conditions, fmt.Sprintf("%s = ?", tableConfig.TenantColumn))
+		args = append(args, s.Tenant)
+	}
+
+	columns := make([]string, 0, len(s.Constraints))
+	for column := range s.Constraints {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	for _, column := range columns {
+		values := s.Constraints[column]
+		// No allowed values means no rows, and IN () is not valid SQL
+		if len(values) == 0 {
+			conditions = append(conditions, "1 = 0")
+			continue
+		}
+		conditions = append(conditions, fmt.Sprintf("%s IN (%s)", column, strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ")))
+		for _, value := range values {
+			args = append(args, value)
+		}
+	}
+	return conditions, args
+}
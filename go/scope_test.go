@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// errAny stands for any error in table-driven tests.
+var errAny = errors.New("any error")
+
+func TestResolveScopeTenants(t *testing.T) {
+	tenanted := &TableConfig{Name: "companies", TenantColumn: "team_id", Exported: true}
+	shared := &TableConfig{Name: "countries", Exported: true}
+	unexported := &TableConfig{Name: "mydb.companies"}
+	bound := &APIKey{Name: "acme", Tenant: "acme"}
+	unbound := &APIKey{Name: "app"}
+
+	tests := []struct {
+		name   string
+		table  *TableConfig
+		key    *APIKey
+		claims *Claims
+		tenant string
+		err    error
+	}{
+		{"key tenant", tenanted, bound, nil, "acme", nil},
+		{"claims tenant", tenanted, unbound, &Claims{Tenant: "beta"}, "beta", nil},
+		{"claims tenant without keys", tenanted, nil, &Claims{Tenant: "beta"}, "beta", nil},
+		{"matching claims and key", tenanted, bound, &Claims{Tenant: "acme"}, "acme", nil},
+		{"claims for another tenant", tenanted, bound, &Claims{Tenant: "beta"}, "", errAny},
+		{"no tenant", tenanted, unbound, nil, "", errTenantRequired},
+		{"no tenant without keys", tenanted, nil, nil, "", errTenantRequired},
+		{"empty claims tenant", tenanted, unbound, &Claims{}, "", errTenantRequired},
+		{"table without tenants", shared, bound, nil, "", nil},
+		{"unexported table unscoped", unexported, unbound, nil, "", nil},
+		{"unexported table for bound key", unexported, bound, nil, "", errTableNotScoped},
+		{"unexported table with claims", unexported, unbound, &Claims{Tenant: "acme"}, "", errTableNotScoped},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scope, err := resolveScope(tt.table, tt.key, tt.claims)
+			switch {
+			case tt.err == errAny && err == nil:
+				t.Fatal("resolveScope succeeded, want an error")
+			case tt.err != errAny && !errors.Is(err, tt.err):
+				t.Fatalf("resolveScope error = %v, want %v", err, tt.err)
+			}
+			if err == nil && scope.Tenant != tt.tenant {
+				t.Errorf("tenant = %q, want %q", scope.Tenant, tt.tenant)
+			}
+		})
+	}
+}
+
+func TestTenantPredicates(t *testing.T) {
+	table := &TableConfig{Name: "companies", TenantColumn: "team_id", Exported: true}
+	conditions, args := SearchScope{Tenant: "acme"}.predicates(table)
+	if len(conditions) != 1 || conditions[0] != "team_id = ?" {
+		t.Errorf("conditions = %q, want [team_id = ?]", conditions)
+	}
+	if len(args) != 1 || args[0] != "acme" {
+		t.Errorf("args = %v, want [acme]", args)
+	}
+
+	// A tenant column is always enforced, so an empty tenant matches only
+	// rows with an empty tenant, never every row
+	conditions, _ = SearchScope{}.predicates(table)
+	if len(conditions) != 1 {
+		t.Errorf("conditions for an empty scope = %q, want the tenant condition", conditions)
+	}
+}
+
+func TestResolveScopeConstraints(t *testing.T) {
+	table := &TableConfig{Name: "orders", ConstraintColumns: []string{"region", "store_id"}, Exported: true}
+	unexported := &TableConfig{Name: "mydb.orders"}
+
+	tests := []struct {
+		name        string
+		table       *TableConfig
+		claims      *Claims
+		constraints map[string][]string
+		err         error
+	}{
+		{"no claims", table, nil, nil, nil},
+		{"sorted values", table, &Claims{Constraints: map[string][]string{"region": {"south", "east"}}},
+			map[string][]string{"region": {"east", "south"}}, nil},
+		{"empty list", table, &Claims{Constraints: map[string][]string{"store_id": {}}},
+			map[string][]string{"store_id": {}}, nil},
+		{"column not allowed", table, &Claims{Constraints: map[string][]string{"team_id": {"1"}}}, nil, errAny},
+		{"column injection", table, &Claims{Constraints: map[string][]string{"1 = 1 OR region": {"x"}}}, nil, errAny},
+		{"unexported table", unexported, &Claims{Constraints: map[string][]string{"region": {"east"}}}, nil, errTableNotScoped},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scope, err := resolveScope(tt.table, nil, tt.claims)
+			switch {
+			case tt.err == errAny && err == nil:
+				t.Fatal("resolveScope succeeded, want an error")
+			case tt.err != errAny && !errors.Is(err, tt.err):
+				t.Fatalf("resolveScope error = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(scope.Constraints, tt.constraints) {
+				t.Errorf("constraints = %v, want %v", scope.Constraints, tt.constraints)
+			}
+		})
+	}
+}
+
+func TestResolveScopeCopiesConstraints(t *testing.T) {
+	table := &TableConfig{Name: "orders", ConstraintColumns: []string{"region"}, Exported: true}
+	claims := &Claims{Constraints: map[string][]string{"region": {"south", "east"}}}
+	if _, err := resolveScope(table, nil, claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Constraints["region"][0] != "south" {
+		t.Error("resolveScope sorted the claims' own values")
+	}
+}
+
+func TestConstraintPredicates(t *testing.T) {
+	table := &TableConfig{Name: "orders", TenantColumn: "team_id", ConstraintColumns: []string{"region", "store_id"}, Exported: true}
+
+	tests := []struct {
+		name       string
+		scope      SearchScope
+		conditions []string
+		args       []interface{}
+	}{
+		{"tenant only", SearchScope{Tenant: "acme"},
+			[]string{"team_id = ?"}, []interface{}{"acme"}},
+		{"columns in sorted order", SearchScope{Tenant: "acme", Constraints: map[string][]string{"store_id": {"7"}, "region": {"east", "south"}}},
+			[]string{"team_id = ?", "region IN (?, ?)", "store_id IN (?)"}, []interface{}{"acme", "east", "south", "7"}},
+		// No allowed values must match no rows, not every row
+		{"empty list", SearchScope{Tenant: "acme", Constraints: map[string][]string{"region": {}}},
+			[]string{"team_id = ?", "1 = 0"}, []interface{}{"acme"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conditions, args := tt.scope.predicates(table)
+			if !reflect.DeepEqual(conditions, tt.conditions) {
+				t.Errorf("conditions = %q, want %q", conditions, tt.conditions)
+			}
+			if !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("args = %v, want %v", args, tt.args)
+			}
+		})
+	}
+}
@@ -1,18 +1,20 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -20,81 +22,117 @@ import (
 )
 
 type SearchConfig struct {
-	Host           string `json:"host"`
-	Port           int    `json:"port"`
-	DBConnection   string `json:"db_connection"`
-	DBHost         string `json:"db_host"`
-	DBPort         string `json:"db_port"`
-	DBName         string `json:"db_name"`
-	DBUser         string `json:"db_user"`
-	DBPass         string `json:"db_pass"`
-	CPUCores       int    `json:"cpu_cores"`
-	MaxConnections int    `json:"max_connections"`
-	CacheDuration  int    `json:"cache_duration"`
-	ResultLimit    int    `json:"result_limit"`
+	Host           string      `json:"host"`
+	Port           int         `json:"port"`
+	DBConnection   string      `json:"db_connection"`
+	DBHost         string      `json:"db_host"`
+	DBPort         string      `json:"db_port"`
+	DBName         string      `json:"db_name"`
+	DBUser         string      `json:"db_user"`
+	DBPass         string      `json:"db_pass"`
+	CPUCores       int         `json:"cpu_cores"`
+	MaxConnections int         `json:"max_connections"`
+	CacheDuration  int         `json:"cache_duration"`
+	CacheMaxBytes  int         `json:"cache_max_bytes"`
+	CacheJanitor   int         `json:"cache_janitor_interval"`
+	CacheGrace     int         `json:"cache_stale_grace"`
+	CacheDriver    string      `json:"cache_driver"`
+	RedisURL       string      `json:"redis_url"`
+	RedisPrefix    string      `json:"redis_prefix"`
+	RedisTimeout   int         `json:"redis_timeout"`
+	ResultLimit    int         `json:"result_limit"`
+	MaxExecutionMs int         `json:"max_execution_ms"`
+	MinTokenSize   int         `json:"min_token_size"`
+	RulesPath      string      `json:"rules_path"`
+	SnapshotPath   string      `json:"snapshot_path"`
+	SnapshotEvery  int         `json:"snapshot_interval"`
+	WarmupKeys     int         `json:"warmup_keys"`
+	WarmupWorkers  int         `json:"warmup_concurrency"`
+	WarmupTimeout  int         `json:"warmup_timeout"`
+	MaxConcurrent  int         `json:"max_concurrent"`
+	BatchLimit     int         `json:"batch_concurrent"`
+	QueueSize      int         `json:"queue_size"`
+	QueueTimeoutMs int         `json:"queue_timeout_ms"`
+	PackageConfig  string      `json:"package_config"`
+	SigningSecret  string      `json:"-"`
+	SigningSkew    int         `json:"signing_skew"`
+	ClaimsSecret   string      `json:"-"`
+	SearchLimit    int         `json:"rate_limit_search"`
+	AdminLimit     int         `json:"rate_limit_admin"`
+	AuthFailures   int         `json:"rate_limit_auth_failures"`
+	MetricsAddr    string      `json:"metrics_addr"`
+	LogLevel       string      `json:"log_level"`
+	LogFormat      string      `json:"log_format"`
+	SlowQueryMs    int         `json:"slow_query_ms"`
+	RedactQueries  bool        `json:"redact_queries"`
+	TLS            TLSSettings `json:"-"`
 }
 
 type TableConfig struct {
-	Name            string   `json:"name"`
+	Name             string   `json:"name"`
 	SearchableFields []string `json:"searchable_fields"`
-	IndexFields     []string `json:"index_fields"`
+	IndexFields      []string `json:"index_fields"`
+	PrimaryKey       string   `json:"primary_key"`
+	TenantColumn     string   `json:"tenant_column"`
+	// ConstraintColumns are the columns signed claims may restrict
+	ConstraintColumns []string `json:"constraint_columns"`
+	// SoftDeleteColumn is set for SoftDeletes models, usually deleted_at
+	SoftDeleteColumn string `json:"soft_delete_column"`
+	// Exported is set when the table came from the package config rather
+	// than the built-in defaults
+	Exported bool `json:"-"`
 }
 
 type SearchRequest struct {
-	Table string `json:"table"`
-	Query string `json:"query"`
-	Mode  string `json:"mode"` // "like" or "fulltext"
+	Table   string `json:"table"`
+	Query   string `json:"query"`
+	Mode    string `json:"mode"` // "like", "fulltext" or "auto"
+	Explain bool   `json:"explain"`
+	// WithTrashed and OnlyTrashed include soft-deleted rows, as Laravel's
+	// withTrashed() and onlyTrashed() do
+	WithTrashed bool `json:"with_trashed"`
+	OnlyTrashed bool `json:"only_trashed"`
 }
 
 type SearchResponse struct {
-	Results    []map[string]interface{} `json:"results"`
-	Count      int                      `json:"count"`
-	TimeMs     int64                    `json:"time_ms"`
-	FromCache  bool                     `json:"from_cache"`
+	Results   []map[string]interface{} `json:"results"`
+	Count     int                      `json:"count"`
+	TimeMs    int64                    `json:"time_ms"`
+	FromCache bool                     `json:"from_cache"`
+	Stale     bool                     `json:"stale,omitempty"`
+	Strategy  string                   `json:"strategy"`
+	Explain   *SearchExplain           `json:"explain,omitempty"`
 }
 
-// Cache implementation
-type Cache struct {
-	items map[string]cacheItem
-	mutex sync.RWMutex
+// CachedResult is what the service caches for each search, before
+// merchandising rules are applied.
+type CachedResult struct {
+	Results  []map[string]interface{} `json:"results"`
+	Count    int                      `json:"count"`
+	TimeMs   int64                    `json:"time_ms"`
+	Strategy string                   `json:"strategy"`
 }
 
-type cacheItem struct {
-	data       []map[string]interface{}
-	count      int
-	timeMs     int64
-	expiration time.Time
-}
-
-func NewCache() *Cache {
-	return &Cache{
-		items: make(map[string]cacheItem),
-	}
-}
-
-func (c *Cache) Set(key string, data []map[string]interface{}, count int, timeMs int64, duration time.Duration) {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	c.items[key] = cacheItem{
-		data:       data,
-		count:      count,
-		timeMs:     timeMs,
-		expiration: time.Now().Add(duration),
-	}
-}
-
-func (c *Cache) Get(key string) ([]map[string]interface{}, int, int64, bool) {
-	c.mutex.RLock()
-	defer c.mutex.RUnlock()
-	item, found := c.items[key]
-	if !found {
-		return nil, 0, 0, false
-	}
-	if time.Now().After(item.expiration) {
-		delete(c.items, key)
-		return nil, 0, 0, false
+// estimateResultSize approximates the memory a cached result holds, for the
+// cache's byte budget. It counts key and value bytes plus a fixed overhead
+// per map entry rather than measuring the heap exactly.
+func estimateResultSize(key string, result CachedResult) int {
+	size := len(key) + len(result.Strategy) + 64
+	for _, row := range result.Results {
+		size += 48
+		for col, value := range row {
+			size += len(col) + 16
+			switch v := value.(type) {
+			case string:
+				size += len(v)
+			case []byte:
+				size += len(v)
+			default:
+				size += 16
+			}
+		}
 	}
-	return item.data, item.count, item.timeMs, true
+	return size
 }
 
 var envPath string // Global variable to store .env path
@@ -129,7 +167,7 @@ func loadConfig() (*SearchConfig, error) {
 
 	err = godotenv.Load(envPath)
 	if err != nil {
-		log.Printf("Warning: Error loading .env file: %v", err)
+		slog.Warn("Error loading .env file", "error", err)
 	}
 
 	// Get number of CPU cores
@@ -149,9 +187,48 @@ func loadConfig() (*SearchConfig, error) {
 		DBUser:         getEnv("LIGHTNING_SEARCH_DB_USERNAME", getEnv("DB_USERNAME", "root")),
 		DBPass:         getEnv("LIGHTNING_SEARCH_DB_PASSWORD", getEnv("DB_PASSWORD", "")),
 		CPUCores:       getEnvInt("LIGHTNING_SEARCH_CPU_CORES", defaultCores),
-		MaxConnections: getEnvInt("LIGHTNING_SEARCH_MAX_CONNECTIONS", cpuCores * 5), // 5 connections per core
+		MaxConnections: getEnvInt("LIGHTNING_SEARCH_MAX_CONNECTIONS", cpuCores*5), // 5 connections per core
 		CacheDuration:  getEnvInt("LIGHTNING_SEARCH_CACHE_DURATION", 300),
+		CacheMaxBytes:  getEnvInt("LIGHTNING_SEARCH_CACHE_MAX_BYTES", 64<<20), // 64MB
+		CacheJanitor:   getEnvInt("LIGHTNING_SEARCH_CACHE_JANITOR_INTERVAL", 60),
+		CacheGrace:     getEnvInt("LIGHTNING_SEARCH_CACHE_STALE_GRACE", 60),
+		CacheDriver:    getEnv("LIGHTNING_SEARCH_CACHE_DRIVER", "local"), // "local" or "redis"
+		RedisURL:       getEnv("LIGHTNING_SEARCH_REDIS_URL", "redis://127.0.0.1:6379/0"),
+		RedisPrefix:    getEnv("LIGHTNING_SEARCH_REDIS_PREFIX", "lightning-search:"),
+		RedisTimeout:   getEnvInt("LIGHTNING_SEARCH_REDIS_TIMEOUT", 250), // milliseconds
 		ResultLimit:    getEnvInt("LIGHTNING_SEARCH_RESULT_LIMIT", 1000),
+		MaxExecutionMs: getEnvInt("LIGHTNING_SEARCH_MAX_EXECUTION_TIME", 5000),
+		MinTokenSize:   getEnvInt("LIGHTNING_SEARCH_MIN_TOKEN_SIZE", 0), // 0 reads innodb_ft_min_token_size
+		RulesPath:      getEnv("LIGHTNING_SEARCH_RULES_PATH", filepath.Join(filepath.Dir(envPath), "storage", "app", "lightning-search", "rules.json")),
+		SnapshotPath:   getEnv("LIGHTNING_SEARCH_CACHE_SNAPSHOT_PATH", filepath.Join(filepath.Dir(envPath), "storage", "app", "lightning-search", "cache-snapshot.json")),
+		SnapshotEvery:  getEnvInt("LIGHTNING_SEARCH_CACHE_SNAPSHOT_INTERVAL", 60), // 0 disables snapshots
+		WarmupKeys:     getEnvInt("LIGHTNING_SEARCH_WARMUP_KEYS", 500),
+		WarmupWorkers:  getEnvInt("LIGHTNING_SEARCH_WARMUP_CONCURRENCY", 4),
+		WarmupTimeout:  getEnvInt("LIGHTNING_SEARCH_WARMUP_TIMEOUT", 30),  // seconds
+		MaxConcurrent:  getEnvInt("LIGHTNING_SEARCH_MAX_CONCURRENT", 0),   // 0 is two per CPU core
+		BatchLimit:     getEnvInt("LIGHTNING_SEARCH_BATCH_CONCURRENT", 0), // 0 is half of MaxConcurrent
+		QueueSize:      getEnvInt("LIGHTNING_SEARCH_QUEUE_SIZE", 100),
+		QueueTimeoutMs: getEnvInt("LIGHTNING_SEARCH_QUEUE_TIMEOUT", 1000), // milliseconds
+		SigningSecret:  getEnv("LIGHTNING_SEARCH_SIGNING_SECRET", ""),
+		SigningSkew:    getEnvInt("LIGHTNING_SEARCH_SIGNING_SKEW", 300), // seconds
+		ClaimsSecret:   getEnv("LIGHTNING_SEARCH_CLAIMS_SECRET", getEnv("LIGHTNING_SEARCH_SIGNING_SECRET", "")),
+		SearchLimit:    getEnvInt("LIGHTNING_SEARCH_RATE_LIMIT_SEARCH", 0), // per minute per client, 0 is unlimited
+		AdminLimit:     getEnvInt("LIGHTNING_SEARCH_RATE_LIMIT_ADMIN", 0),
+		AuthFailures:   getEnvInt("LIGHTNING_SEARCH_RATE_LIMIT_AUTH_FAILURES", 30), // failed key checks per minute per IP
+		MetricsAddr:    getEnv("LIGHTNING_SEARCH_METRICS_ADDR", ""),                // serves /metrics on its own listener when set
+		LogLevel:       getEnv("LIGHTNING_SEARCH_LOG_LEVEL", "info"),
+		LogFormat:      getEnv("LIGHTNING_SEARCH_LOG_FORMAT", "text"),  // or json
+		SlowQueryMs:    getEnvInt("LIGHTNING_SEARCH_SLOW_QUERY_MS", 0), // 0 turns the slow query log off
+		RedactQueries:  getEnv("LIGHTNING_SEARCH_LOG_REDACT_QUERIES", "false") == "true",
+		TLS: TLSSettings{
+			CertFile:   getEnv("LIGHTNING_SEARCH_TLS_CERT", ""),
+			KeyFile:    getEnv("LIGHTNING_SEARCH_TLS_KEY", ""),
+			MinVersion: getEnv("LIGHTNING_SEARCH_TLS_MIN_VERSION", "1.2"),
+			Ciphers:    getEnv("LIGHTNING_SEARCH_TLS_CIPHERS", "modern"),
+			ClientCA:   getEnv("LIGHTNING_SEARCH_TLS_CLIENT_CA", ""),
+			ClientAuth: getEnv("LIGHTNING_SEARCH_TLS_CLIENT_AUTH", "require"),
+		},
+		PackageConfig: getEnv("LIGHTNING_SEARCH_CONFIG_PATH", filepath.Join(filepath.Dir(envPath), "storage", "app", "lightning-search", "config.json")),
 	}, nil
 }
 
@@ -171,7 +248,33 @@ func getEnvInt(key string, fallback int) int {
 	return fallback
 }
 
-func loadTableConfig(table string) (*TableConfig, error) {
+// tableNamePattern matches a table name, optionally qualified with its
+// database. Names end up in SQL, so nothing else is accepted.
+var tableNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$]*(\.[A-Za-z_][A-Za-z0-9_$]*)?$`)
+
+var errInvalidTable = errors.New("invalid table name")
+
+// loadTableConfig returns the configuration for a table, as exported by
+// lightning-search:start, falling back to defaults for unknown tables.
+// Exported tables keep their scoping settings even when they don't list
+// searchable fields.
+func loadTableConfig(tables map[string]TableConfig, table string) (*TableConfig, error) {
+	if !tableNamePattern.MatchString(table) {
+		return nil, errInvalidTable
+	}
+
+	if exported, found := tables[table]; found {
+		exported.Name = table
+		exported.Exported = true
+		if exported.PrimaryKey == "" {
+			exported.PrimaryKey = "id"
+		}
+		if len(exported.SearchableFields) == 0 {
+			exported.SearchableFields = []string{"name", "description", "content"}
+		}
+		return &exported, nil
+	}
+
 	// Try to load config from Laravel's config directory
 	configPath := filepath.Join(filepath.Dir(filepath.Dir(os.Args[0])), "config", "lightning-search.php")
 	if _, err := os.Stat(configPath); os.IsNotExist(err) {
@@ -180,59 +283,292 @@ func loadTableConfig(table string) (*TableConfig, error) {
 
 	// For now, return a default config - in future versions we'll parse the PHP config file
 	return &TableConfig{
-		Name:            table,
+		Name:             table,
 		SearchableFields: []string{"name", "description", "content"}, // Default searchable fields
-		IndexFields:     []string{"id"},
+		IndexFields:      []string{"id"},
+		PrimaryKey:       "id",
 	}, nil
 }
 
+// buildSearchQuery returns the SQL and arguments for a search in the given
+// mode, restricted to the rows scope allows and to the requested trashed
+// rows.
+func buildSearchQuery(tableConfig *TableConfig, mode, search string, limit int, scope SearchScope, trashed string) (string, []interface{}) {
+	var query string
+	var args []interface{}
+
+	scopeConditions, scopeArgs := scope.predicates(tableConfig)
+	if condition := softDeletePredicate(tableConfig, trashed); condition != "" {
+		scopeConditions = append(scopeConditions, condition)
+	}
+	scopeSQL := ""
+	for _, condition := range scopeConditions {
+		scopeSQL += " AND " + condition
+	}
+
+	switch mode {
+	case "fulltext":
+		// Use MATCH AGAINST with relevance scoring
+		query = fmt.Sprintf(
+			"SELECT *, MATCH(%s) AGAINST(? IN BOOLEAN MODE) as relevance FROM %s WHERE MATCH(%s) AGAINST(? IN BOOLEAN MODE)%s ORDER BY relevance DESC LIMIT %d",
+			strings.Join(tableConfig.SearchableFields, ","),
+			tableConfig.Name,
+			strings.Join(tableConfig.SearchableFields, ","),
+			scopeSQL,
+			limit,
+		)
+		args = append([]interface{}{search, search}, scopeArgs...)
+	default: // "like" mode
+		// Use UNION ALL for better performance with multiple fields
+		conditions := make([]string, len(tableConfig.SearchableFields))
+		for i, field := range tableConfig.SearchableFields {
+			conditions[i] = fmt.Sprintf("SELECT *, 1 as relevance FROM %s WHERE %s LIKE ?%s", tableConfig.Name, field, scopeSQL)
+			args = append(args, "%"+search+"%")
+			args = append(args, scopeArgs...)
+		}
+		query = fmt.Sprintf(
+			"%s ORDER BY relevance DESC LIMIT %d",
+			strings.Join(conditions, " UNION ALL "),
+			limit,
+		)
+	}
+
+	return query, args
+}
+
+// executeSearch runs each strategy for the request in turn until one finds
+// something, and returns the result along with the SQL that produced it.
+func executeSearch(ctx context.Context, db *sql.DB, tableConfig *TableConfig, req SearchRequest, scope SearchScope, config *SearchConfig, metrics *Metrics) (CachedResult, string, []interface{}, error) {
+	startTime := time.Now()
+
+	var query, strategy string
+	var args []interface{}
+	var results []map[string]interface{}
+	trashed, err := req.trashed()
+	if err != nil {
+		return CachedResult{}, "", nil, err
+	}
+	for _, strategy = range searchStrategies(req.Mode, req.Query, config.MinTokenSize) {
+		query, args = buildSearchQuery(tableConfig, strategy, req.Query, config.ResultLimit, scope, trashed)
+		queryStart := time.Now()
+		results, err = runSearch(ctx, db, query, args)
+		elapsed := time.Since(queryStart)
+		metrics.ObserveStrategy(strategy, elapsed)
+		if config.SlowQueryMs > 0 && elapsed >= time.Duration(config.SlowQueryMs)*time.Millisecond {
+			slog.WarnContext(ctx, "Slow query",
+				"table", tableConfig.Name,
+				"strategy", strategy,
+				"sql", query,
+				argsAttr(args),
+				"duration_ms", elapsed.Milliseconds(),
+				"rows", len(results),
+			)
+		}
+		if err != nil {
+			return CachedResult{}, query, args, err
+		}
+		if len(results) > 0 {
+			break
+		}
+	}
+
+	return CachedResult{
+		Results:  results,
+		Count:    len(results),
+		TimeMs:   time.Since(startTime).Milliseconds(),
+		Strategy: strategy,
+	}, query, args, nil
+}
+
+// runSearch executes a search query and returns its rows.
+func runSearch(ctx context.Context, db *sql.DB, query string, args []interface{}) ([]map[string]interface{}, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanRows(rows)
+}
+
+// scanRows reads every row into a column-name keyed map, converting byte
+// slices to strings so they encode as JSON text.
+func scanRows(rows *sql.Rows) ([]map[string]interface{}, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("error getting column names: %v", err)
+	}
+
+	var results []map[string]interface{}
+	for rows.Next() {
+		// Create a slice of interface{} to hold the values
+		values := make([]interface{}, len(columns))
+		valuePtrs := make([]interface{}, len(columns))
+		for i := range columns {
+			valuePtrs[i] = &values[i]
+		}
+
+		// Scan the row into the values
+		if err := rows.Scan(valuePtrs...); err != nil {
+			return nil, fmt.Errorf("error scanning row: %v", err)
+		}
+
+		// Create a map for this row
+		row := make(map[string]interface{})
+		for i, col := range columns {
+			var v interface{}
+			val := values[i]
+			b, ok := val.([]byte)
+			if ok {
+				v = string(b)
+			} else {
+				v = val
+			}
+			row[col] = v
+		}
+
+		results = append(results, row)
+	}
+	return results, rows.Err()
+}
+
+// fetchByIDs loads rows by primary key, used to pull in pinned records that
+// the search itself did not return. Pinned records outside scope, or
+// trashed records the search would have excluded, are not returned.
+func fetchByIDs(ctx context.Context, db *sql.DB, tableConfig *TableConfig, ids []string, scope SearchScope, trashed string) ([]map[string]interface{}, error) {
+	placeholders := make([]string, len(ids))
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+
+	conditions, scopeArgs := scope.predicates(tableConfig)
+	if condition := softDeletePredicate(tableConfig, trashed); condition != "" {
+		conditions = append(conditions, condition)
+	}
+	conditions = append([]string{fmt.Sprintf("%s IN (%s)", tableConfig.PrimaryKey, strings.Join(placeholders, ","))}, conditions...)
+	return runSearch(ctx, db, fmt.Sprintf(
+		"SELECT * FROM %s WHERE %s",
+		tableConfig.Name,
+		strings.Join(conditions, " AND "),
+	), append(args, scopeArgs...))
+}
+
 func main() {
 	config, err := loadConfig()
 	if err != nil {
-		log.Fatal("Configuration error: ", err)
+		fatal("Configuration error", "error", err)
+	}
+	if err := setupLogging(config.LogLevel, config.LogFormat, config.RedactQueries); err != nil {
+		fatal("Configuration error", "error", err)
 	}
 
 	// Validate environment
 	if config.DBName == "" {
-		log.Fatal("Database configuration missing. Please check your .env file and ensure DB_DATABASE is set.")
+		fatal("Database configuration missing. Please check your .env file and ensure DB_DATABASE is set.")
 	}
 
 	// Additional validation for non-local connections without password
 	isLocalhost := config.DBHost == "127.0.0.1" || config.DBHost == "localhost" || config.DBHost == "::1"
 	if config.DBPass == "" && !isLocalhost {
-		log.Printf("⚠️  Warning: Database password is not set, but you are connecting to a non-local database (%s).", config.DBHost)
-		log.Printf("This is a security risk if this is a production or staging environment.")
+		slog.Warn("Database password is not set, but you are connecting to a non-local database. This is a security risk if this is a production or staging environment.", "db_host", config.DBHost)
 	}
 
 	// Set CPU cores
 	runtime.GOMAXPROCS(config.CPUCores)
+	if config.MaxConcurrent <= 0 {
+		config.MaxConcurrent = config.CPUCores * 2
+	}
 
 	// Print technical setup
-	log.Printf("=== Lightning Search Service ===")
-	log.Printf("CPU Cores: %d/%d", config.CPUCores, runtime.NumCPU())
-	log.Printf("Max DB Connections: %d", config.MaxConnections)
-	log.Printf("Cache Duration: %ds", config.CacheDuration)
-	log.Printf("Result Limit: %d", config.ResultLimit)
-	log.Printf("Go Version: %s", runtime.Version())
-	log.Printf("OS/Arch: %s/%s", runtime.GOOS, runtime.GOARCH)
-	log.Printf("Environment: %s", envPath)
-	log.Printf("=============================")
+	slog.Info("Lightning Search Service",
+		"cpu_cores", fmt.Sprintf("%d/%d", config.CPUCores, runtime.NumCPU()),
+		"max_db_connections", config.MaxConnections,
+		"cache_duration_s", config.CacheDuration,
+		"cache_budget_bytes", config.CacheMaxBytes,
+		"cache_driver", config.CacheDriver,
+		"result_limit", config.ResultLimit,
+		"max_execution_ms", config.MaxExecutionMs,
+		"max_concurrent", config.MaxConcurrent,
+		"queue_size", config.QueueSize,
+		"queue_timeout_ms", config.QueueTimeoutMs,
+		"slow_query_ms", config.SlowQueryMs,
+		"redact_queries", config.RedactQueries,
+		"go_version", runtime.Version(),
+		"os_arch", runtime.GOOS+"/"+runtime.GOARCH,
+		"environment", envPath,
+	)
 
 	// Create cache
-	cache := NewCache()
+	local := NewCache(config.CacheMaxBytes, time.Duration(config.CacheJanitor)*time.Second, estimateResultSize)
+	var cache CacheBackend = localBackend{local}
+	if config.CacheDriver == "redis" {
+		shared, err := NewRedisCache(config.RedisURL, config.RedisPrefix, config.MaxConnections, time.Duration(config.RedisTimeout)*time.Millisecond)
+		if err != nil {
+			fatal("Cache error", "error", err)
+		}
+		fallback := newFallbackCache(shared, local, 30*time.Second)
+		if err := shared.Ping(); err != nil {
+			fallback.failed(err)
+		}
+		cache = fallback
+	}
+	defer cache.Close()
+	flights := newFlightGroup[CachedResult]()
+
+	// Admit at most MaxConcurrent searches to the database at once
+	governor := NewGovernor(config.MaxConcurrent, config.BatchLimit, config.QueueSize, time.Duration(config.QueueTimeoutMs)*time.Millisecond)
+
+	// Load API keys and the CORS policy exported from config/lightning-search.php
+	pkg, err := loadPackageConfig(config.PackageConfig)
+	if err != nil {
+		fatal("Configuration error", "error", err)
+	}
+	auth, err := NewAuthenticator(pkg.Keys)
+	if err != nil {
+		fatal("Configuration error", "error", err)
+	}
+	if auth.Enabled() {
+		slog.Info("Loaded API keys", "count", len(pkg.Keys), "path", config.PackageConfig)
+	} else {
+		slog.Warn("No API keys configured, so any client that can reach the service can search every table")
+	}
+
+	claimsVerifier := NewClaimsVerifier(config.ClaimsSecret)
+
+	// Per-client rate limits, applied after authentication, and a per-IP
+	// limit on failed authentication attempts
+	limiter := NewRateLimiter(map[string]int{
+		opSearch:          config.SearchLimit,
+		opAdmin:           config.AdminLimit,
+		routeAuthFailures: config.AuthFailures,
+	})
+	auth.ThrottleFailures(limiter)
+	guard := func(op string, next http.HandlerFunc) http.HandlerFunc {
+		return auth.Require(op, limiter.Limit(op, next))
+	}
+
+	// Load merchandising rules
+	rules, err := NewRuleStore(config.RulesPath)
+	if err != nil {
+		fatal("Rules error", "error", err)
+	}
+	slog.Info("Loaded merchandising rules", "count", rules.Len(), "path", config.RulesPath)
 
-	// Database connection
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true",
+	// Database connection. max_execution_time is set on every connection,
+	// so MySQL stops runaway searches even after the client has gone.
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true&max_execution_time=%d",
 		config.DBUser,
 		config.DBPass,
 		config.DBHost,
 		config.DBPort,
 		config.DBName,
+		config.MaxExecutionMs,
 	)
 
 	db, err := sql.Open(config.DBConnection, dsn)
 	if err != nil {
-		log.Fatal(err)
+		fatal("Server error", "error", err)
 	}
 	defer db.Close()
 
@@ -243,21 +579,55 @@ func main() {
 
 	// Test connection
 	if err := db.Ping(); err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+		fatal("Failed to connect to database", "error", err)
 	}
 
-	// Define HTTP handler for search
-	http.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
-		// Set CORS headers
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
+	// Auto mode sends tokens FULLTEXT can't index to LIKE instead
+	if config.MinTokenSize <= 0 {
+		config.MinTokenSize = detectMinTokenSize(db)
+	}
+	slog.Info("FULLTEXT min token size", "size", config.MinTokenSize)
+
+	metrics := NewMetrics(cache, db, governor, limiter)
+
+	// Replay the searches that were hot before the last shutdown, so the
+	// first users after a deploy don't all pay the full database latency
+	hot := NewHotSearches(config.SnapshotPath, config.WarmupKeys)
+	if config.SnapshotEvery > 0 {
+		searches, err := hot.Load()
+		if err != nil {
+			slog.Warn("Cache snapshot not loaded", "error", err)
+		}
+		if len(searches) > 0 {
+			startTime := time.Now()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.WarmupTimeout)*time.Second)
+			warmed := warmCache(ctx, searches, config.WarmupWorkers, func(ctx context.Context, req SearchRequest, scope SearchScope) error {
+				canonical := canonicalSearch(req, scope)
+				req = canonical.Request(false)
+				tableConfig, err := loadTableConfig(pkg.Tables, req.Table)
+				if err != nil {
+					return err
+				}
+				// The table's settings may have changed since the snapshot
+				if err := scope.validate(tableConfig); err != nil {
+					return err
+				}
+				result, _, _, err := executeSearch(ctx, db, tableConfig, req, scope, config, metrics)
+				if err != nil {
+					return err
+				}
+				cache.Set(canonical.Key(), result, time.Duration(config.CacheDuration)*time.Second, time.Duration(config.CacheGrace)*time.Second, cacheTags(tableConfig, result.Results)...)
+				return nil
+			})
+			cancel()
+			slog.Info("Warmed cache", "warmed", warmed, "searches", len(searches), "duration_ms", time.Since(startTime).Milliseconds())
 		}
 
+		go hot.Run(context.Background(), time.Duration(config.SnapshotEvery)*time.Second)
+	}
+
+	// Define HTTP handler for search
+	http.HandleFunc("/search", guard(opSearch, func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
@@ -278,137 +648,257 @@ func main() {
 		}
 
 		// Load table configuration
-		tableConfig, err := loadTableConfig(req.Table)
+		tableConfig, err := loadTableConfig(pkg.Tables, req.Table)
+		if errors.Is(err, errInvalidTable) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Configuration error: %v", err), http.StatusInternalServerError)
 			return
 		}
 
+		if !requestKey(r).AllowsTable(req.Table) {
+			http.Error(w, "API key is not allowed to search this table", http.StatusForbidden)
+			return
+		}
+
+		// Restrict the search to the caller's tenant and signed constraints
+		claims, err := claimsVerifier.FromRequest(r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid claims: %v", err), http.StatusUnauthorized)
+			return
+		}
+		scope, err := resolveScope(tableConfig, requestKey(r), claims)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
 		// Validate request
-		if req.Table == "" || req.Query == "" {
+		canonical := canonicalSearch(req, scope)
+		setRequestMode(r, canonical.Mode)
+		if req.Table == "" || canonical.Query == "" {
 			http.Error(w, "Missing required fields", http.StatusBadRequest)
 			return
 		}
+		if _, err := req.trashed(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Rules are applied after ranking on every response, so cached
+		// results stay rule-free and rule changes take effect immediately
+		matchedRules := rules.Match(req.Table, req.Query, time.Now())
+
+		// Search with the canonical form, so requests that share a cache
+		// entry also share the query that fills it
+		req = canonical.Request(req.Explain)
+		merchandise := func(results []map[string]interface{}) ([]map[string]interface{}, []RuleAdjustment, error) {
+			results, adjustments, err := applyRules(matchedRules, tableConfig.PrimaryKey, results, func(ids []string) ([]map[string]interface{}, error) {
+				return fetchByIDs(r.Context(), db, tableConfig, ids, scope, canonical.Trashed)
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(results) > config.ResultLimit {
+				results = results[:config.ResultLimit]
+			}
+			return results, adjustments, nil
+		}
 
-		startTime := time.Now()
+		cacheKey := canonical.Key()
+		cacheTTL := time.Duration(config.CacheDuration) * time.Second
+		cacheGrace := time.Duration(config.CacheGrace) * time.Second
+		if !req.Explain {
+			hot.Record(cacheKey, req, scope)
+		}
+		refresh := func(ctx context.Context, l lane) (CachedResult, error) {
+			release, err := governor.Acquire(ctx, l)
+			if err != nil {
+				return CachedResult{}, err
+			}
+			defer release()
 
-		// Check cache
-		cacheKey := fmt.Sprintf("%s:%s:%s", req.Table, req.Query, req.Mode)
-		if results, count, timeMs, found := cache.Get(cacheKey); found {
+			result, _, _, err := executeSearch(ctx, db, tableConfig, req, scope, config, metrics)
+			if err != nil {
+				return result, err
+			}
+			cache.Set(cacheKey, result, cacheTTL, cacheGrace, cacheTags(tableConfig, result.Results)...)
+			return result, nil
+		}
+
+		// Check cache, unless the caller wants to see the query that ran
+		if cached, stale, found := cache.GetStale(cacheKey); found && !req.Explain {
+			if stale {
+				// Serve the expired entry once more while a single
+				// background refresh replaces it
+				flights.DoAsync(cacheKey, func() (CachedResult, error) {
+					ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.MaxExecutionMs)*time.Millisecond)
+					defer cancel()
+					result, err := refresh(ctx, laneBatch)
+					if err != nil {
+						slog.Warn("Background refresh failed", "table", req.Table, queryAttr("query", req.Query), "error", err)
+					}
+					return result, err
+				})
+			}
+
+			results, _, err := merchandise(cached.Results)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Search failed", "table", req.Table, queryAttr("query", req.Query), "error", err)
+				http.Error(w, fmt.Sprintf("Database error: %v", err), http.StatusInternalServerError)
+				return
+			}
 			response := SearchResponse{
 				Results:   results,
-				Count:    count,
-				TimeMs:   timeMs,
+				Count:     len(results),
+				TimeMs:    cached.TimeMs,
 				FromCache: true,
+				Stale:     stale,
+				Strategy:  cached.Strategy,
 			}
+			w.Header().Set("Content-Type", "application/json")
 			json.NewEncoder(w).Encode(response)
 			return
 		}
 
-		// Build query based on mode
+		var result CachedResult
 		var query string
 		var args []interface{}
-
-		switch req.Mode {
-		case "fulltext":
-			// Use MATCH AGAINST with relevance scoring
-			query = fmt.Sprintf(
-				"SELECT *, MATCH(%s) AGAINST(? IN BOOLEAN MODE) as relevance FROM %s WHERE MATCH(%s) AGAINST(? IN BOOLEAN MODE) ORDER BY relevance DESC LIMIT %d",
-				strings.Join(tableConfig.SearchableFields, ","),
-				req.Table,
-				strings.Join(tableConfig.SearchableFields, ","),
-				config.ResultLimit,
-			)
-			args = []interface{}{req.Query, req.Query}
-		default: // "like" mode
-			// Use UNION ALL for better performance with multiple fields
-			conditions := make([]string, len(tableConfig.SearchableFields))
-			args = make([]interface{}, len(tableConfig.SearchableFields))
-			for i, field := range tableConfig.SearchableFields {
-				conditions[i] = fmt.Sprintf("SELECT *, 1 as relevance FROM %s WHERE %s LIKE ?", req.Table, field)
-				args[i] = "%" + req.Query + "%"
+		if req.Explain {
+			// Explain needs the query that ran, so it never shares one
+			var release func()
+			release, err = governor.Acquire(r.Context(), requestLane(r))
+			if err == nil {
+				result, query, args, err = executeSearch(r.Context(), db, tableConfig, req, scope, config, metrics)
+				release()
+			}
+			if err == nil {
+				cache.Set(cacheKey, result, cacheTTL, cacheGrace, cacheTags(tableConfig, result.Results)...)
+			}
+		} else {
+			// Identical searches in flight share one database execution
+			var shared bool
+			result, err, shared = flights.Do(cacheKey, func() (CachedResult, error) {
+				return refresh(r.Context(), requestLane(r))
+			})
+			if err != nil && shared && errors.Is(err, context.Canceled) && r.Context().Err() == nil {
+				// The request we were sharing with went away; run our own
+				result, err = refresh(r.Context(), requestLane(r))
 			}
-			query = fmt.Sprintf(
-				"%s ORDER BY relevance DESC LIMIT %d",
-				strings.Join(conditions, " UNION ALL "),
-				config.ResultLimit,
-			)
 		}
-
-		// Execute query
-		rows, err := db.Query(query, args...)
+		if r.Context().Err() != nil {
+			slog.InfoContext(r.Context(), "Search cancelled by client", "table", req.Table, queryAttr("query", req.Query))
+			return
+		}
+		if isOverloaded(err) {
+			w.Header().Set("Retry-After", strconv.Itoa(governor.RetryAfter()))
+			http.Error(w, "Too many searches in progress", http.StatusTooManyRequests)
+			return
+		}
 		if err != nil {
+			slog.ErrorContext(r.Context(), "Search failed", "table", req.Table, queryAttr("query", req.Query), "error", err)
 			http.Error(w, fmt.Sprintf("Database error: %v", err), http.StatusInternalServerError)
 			return
 		}
-		defer rows.Close()
 
-		// Get column names
-		columns, err := rows.Columns()
+		// Apply pinned and hidden results
+		results, adjustments, err := merchandise(result.Results)
 		if err != nil {
-			http.Error(w, "Error getting column names", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Search failed", "table", req.Table, queryAttr("query", req.Query), "error", err)
+			http.Error(w, fmt.Sprintf("Database error: %v", err), http.StatusInternalServerError)
 			return
 		}
 
-		// Prepare result slice
-		var results []map[string]interface{}
-		count := 0
-
-		// Scan rows
-		for rows.Next() {
-			// Create a slice of interface{} to hold the values
-			values := make([]interface{}, len(columns))
-			valuePtrs := make([]interface{}, len(columns))
-			for i := range columns {
-				valuePtrs[i] = &values[i]
-			}
-
-			// Scan the row into the values
-			if err := rows.Scan(valuePtrs...); err != nil {
-				http.Error(w, fmt.Sprintf("Error scanning row: %v", err), http.StatusInternalServerError)
+		var explain *SearchExplain
+		if req.Explain {
+			explain, err = explainSearch(r.Context(), db, tableConfig, query, args, explainTerms(req.Query), results, adjustments)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Search failed", "table", req.Table, queryAttr("query", req.Query), "error", err)
+				http.Error(w, fmt.Sprintf("Database error: %v", err), http.StatusInternalServerError)
 				return
 			}
-
-			// Create a map for this row
-			row := make(map[string]interface{})
-			for i, col := range columns {
-				var v interface{}
-				val := values[i]
-				b, ok := val.([]byte)
-				if ok {
-					v = string(b)
-				} else {
-					v = val
-				}
-				row[col] = v
-			}
-
-			results = append(results, row)
-			count++
 		}
 
-		// Calculate execution time
-		executionTime := time.Since(startTime).Milliseconds()
-
-		// Cache results
-		cache.Set(cacheKey, results, count, executionTime, time.Duration(config.CacheDuration)*time.Second)
-
 		// Return response
 		response := SearchResponse{
 			Results:   results,
-			Count:    count,
-			TimeMs:   executionTime,
+			Count:     len(results),
+			TimeMs:    result.TimeMs,
 			FromCache: false,
+			Strategy:  result.Strategy,
+			Explain:   explain,
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
-	})
+	}))
+
+	// Admin endpoints for merchandising rules
+	http.HandleFunc("/admin/rules", guard(opAdmin, handleRules(rules)))
+
+	// Operator endpoints for the cache
+	http.HandleFunc("/cache", guard(opAdmin, handleCacheClear(cache)))
+	http.HandleFunc("/cache/stats", guard(opAdmin, handleCacheStats(cache)))
+	http.HandleFunc("/cache/invalidate", guard(opAdmin, handleCacheInvalidate(cache)))
+	http.HandleFunc("/admission/stats", guard(opAdmin, handleAdmissionStats(governor)))
+	http.HandleFunc("/ratelimit/stats", guard(opAdmin, handleRateLimitStats(limiter)))
+
+	// Prometheus metrics, on the main listener unless they have their own.
+	// Scrapers can't sign requests, so a separate listener on an internal
+	// address is the way to go when signing is enabled.
+	if config.MetricsAddr == "" {
+		http.HandleFunc("/metrics", guard(opAdmin, handleMetrics(metrics)))
+	} else {
+		metricsMux := http.NewServeMux()
+		metricsMux.HandleFunc("/metrics", handleMetrics(metrics))
+		go func() {
+			slog.Info("Serving metrics", "addr", config.MetricsAddr)
+			if err := http.ListenAndServe(config.MetricsAddr, metricsMux); err != nil {
+				fatal("Metrics server error", "error", err)
+			}
+		}()
+	}
+
+	// Require signed requests when a shared secret is set
+	var handler http.Handler = http.DefaultServeMux
+	if config.SigningSecret != "" {
+		handler = NewRequestSigner(config.SigningSecret, time.Duration(config.SigningSkew)*time.Second).Wrap(handler)
+		slog.Info("Request signing enabled", "skew_s", config.SigningSkew)
+	}
+
+	// CORS goes outermost so preflights are answered before any checks and
+	// error responses are still readable by allowed origins
+	handler = pkg.CORS.Wrap(handler)
+	slog.Info("CORS allowed origins", "origins", strings.Join(pkg.CORS.Origins, ", "))
+
+	// Measure everything, including requests rejected by the checks above
+	handler = metrics.Wrap(http.DefaultServeMux, handler)
+	handler = withRequestIDs(handler)
 
 	// Start server
-	addr := fmt.Sprintf("%s:%d", config.Host, config.Port)
-	log.Printf("Starting server on %s", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Fatal(err)
+	server := &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", config.Host, config.Port),
+		Handler: handler,
+	}
+	if config.TLS.CertFile == "" {
+		slog.Info("Starting server", "addr", server.Addr)
+		if err := server.ListenAndServe(); err != nil {
+			fatal("Server error", "error", err)
+		}
+		return
+	}
+
+	server.TLSConfig, err = newTLSConfig(config.TLS, 10*time.Second)
+	if err != nil {
+		fatal("TLS error", "error", err)
+	}
+	if config.TLS.ClientCA != "" {
+		slog.Info("Client certificates required", "ca", config.TLS.ClientCA, "mode", config.TLS.ClientAuth)
+	}
+	slog.Info("Starting TLS server", "addr", server.Addr)
+	if err := server.ListenAndServeTLS("", ""); err != nil {
+		fatal("Server error", "error", err)
 	}
 }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedRequest builds a POST to /search signed the way the PHP client
+// signs it.
+func signedRequest(signer *RequestSigner, timestamp time.Time, nonce, body string) *http.Request {
+	r := httptest.NewRequest("POST", "/search?debug=1", strings.NewReader(body))
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	r.Header.Set(headerTimestamp, ts)
+	r.Header.Set(headerNonce, nonce)
+	r.Header.Set(headerSignature, signer.Sign("POST", "/search?debug=1", ts, nonce, []byte(body)))
+	return r
+}
+
+func TestRequestSignerWrap(t *testing.T) {
+	signer := NewRequestSigner("secret", 5*time.Minute)
+	other := NewRequestSigner("other", 5*time.Minute)
+	now := time.Now()
+	body := `{"table":"companies","query":"acme"}`
+
+	tests := []struct {
+		name    string
+		request func() *http.Request
+		status  int
+	}{
+		{"valid", func() *http.Request {
+			return signedRequest(signer, now, "n-valid", body)
+		}, http.StatusOK},
+		{"preflight", func() *http.Request {
+			return httptest.NewRequest("OPTIONS", "/search", nil)
+		}, http.StatusOK},
+		{"unsigned", func() *http.Request {
+			return httptest.NewRequest("POST", "/search", strings.NewReader(body))
+		}, http.StatusUnauthorized},
+		{"wrong secret", func() *http.Request {
+			return signedRequest(other, now, "n-secret", body)
+		}, http.StatusUnauthorized},
+		{"too old", func() *http.Request {
+			return signedRequest(signer, now.Add(-6*time.Minute), "n-old", body)
+		}, http.StatusUnauthorized},
+		{"too far ahead", func() *http.Request {
+			return signedRequest(signer, now.Add(6*time.Minute), "n-ahead", body)
+		}, http.StatusUnauthorized},
+		{"within skew", func() *http.Request {
+			return signedRequest(signer, now.Add(-4*time.Minute), "n-skew", body)
+		}, http.StatusOK},
+		{"malformed timestamp", func() *http.Request {
+			r := signedRequest(signer, now, "n-malformed", body)
+			r.Header.Set(headerTimestamp, "yesterday")
+			return r
+		}, http.StatusUnauthorized},
+		{"tampered body", func() *http.Request {
+			r := signedRequest(signer, now, "n-body", body)
+			r.Body = io.NopCloser(strings.NewReader(`{"table":"users","query":"acme"}`))
+			return r
+		}, http.StatusUnauthorized},
+		{"tampered query string", func() *http.Request {
+			r := signedRequest(signer, now, "n-query", body)
+			r.URL.RawQuery = "debug=0"
+			r.RequestURI = "/search?debug=0"
+			return r
+		}, http.StatusUnauthorized},
+		{"tampered nonce", func() *http.Request {
+			r := signedRequest(signer, now, "n-nonce", body)
+			r.Header.Set(headerNonce, "n-other")
+			return r
+		}, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			handler := signer.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := io.ReadAll(r.Body)
+				got = string(b)
+			}))
+			r := tt.request()
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d (%s)", w.Code, tt.status, strings.TrimSpace(w.Body.String()))
+			}
+			// The handler must still be able to read a verified body
+			if tt.status == http.StatusOK && r.Method == "POST" && got != body {
+				t.Errorf("handler read body %q, want %q", got, body)
+			}
+		})
+	}
+}
+
+func TestRequestSignerRejectsReplays(t *testing.T) {
+	signer := NewRequestSigner("secret", 5*time.Minute)
+	handler := signer.Wrap(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	now := time.Now()
+
+	for i, want := range []int{http.StatusOK, http.StatusUnauthorized} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, signedRequest(signer, now, "n-replay", "{}"))
+		if w.Code != want {
+			t.Errorf("attempt %d: status = %d, want %d", i+1, w.Code, want)
+		}
+	}
+
+	// A request that fails verification must not use up its nonce
+	forged := signedRequest(signer, now, "n-forged", "{}")
+	forged.Header.Set(headerSignature, strings.Repeat("0", 64))
+	handler.ServeHTTP(httptest.NewRecorder(), forged)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, signedRequest(signer, now, "n-forged", "{}"))
+	if w.Code != http.StatusOK {
+		t.Errorf("genuine request after a forged one with its nonce: status = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestRequestSignerForgetsExpiredNonces(t *testing.T) {
+	signer := NewRequestSigner("secret", time.Minute)
+	now := time.Now()
+
+	if !signer.useNonce("n", now) {
+		t.Fatal("new nonce rejected")
+	}
+	if signer.useNonce("n", now.Add(time.Minute)) {
+		t.Error("nonce accepted again within the window")
+	}
+	// By now a request with this nonce would fail the timestamp check, so
+	// the nonce no longer needs remembering
+	if !signer.useNonce("n", now.Add(3*time.Minute)) {
+		t.Error("nonce still rejected after it expired")
+	}
+	if len(signer.nonces) != 1 {
+		t.Errorf("%d nonces remembered, want 1", len(signer.nonces))
+	}
+}
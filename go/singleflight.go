@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sync"
+)
+
+// flightGroup coalesces concurrent calls for the same key, so identical
+// searches arriving together share a single database execution.
+type flightGroup[V any] struct {
+	mutex sync.Mutex
+	calls map[string]*flightCall[V]
+}
+
+type flightCall[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+func newFlightGroup[V any]() *flightGroup[V] {
+	return &flightGroup[V]{calls: make(map[string]*flightCall[V])}
+}
+
+// Do runs fn for key, or waits for the call already in flight for key and
+// returns its result. shared reports whether the result came from another
+// caller's execution.
+func (g *flightGroup[V]) Do(key string, fn func() (V, error)) (value V, err error, shared bool) {
+	g.mutex.Lock()
+	if call, found := g.calls[key]; found {
+		g.mutex.Unlock()
+		<-call.done
+		return call.value, call.err, true
+	}
+	call := &flightCall[V]{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mutex.Unlock()
+
+	g.run(key, call, fn)
+	return call.value, call.err, false
+}
+
+// DoAsync starts fn for key in the background unless a call for key is
+// already in flight, and reports whether it started one.
+func (g *flightGroup[V]) DoAsync(key string, fn func() (V, error)) bool {
+	g.mutex.Lock()
+	if _, found := g.calls[key]; found {
+		g.mutex.Unlock()
+		return false
+	}
+	call := &flightCall[V]{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mutex.Unlock()
+
+	go g.run(key, call, fn)
+	return true
+}
+
+func (g *flightGroup[V]) run(key string, call *flightCall[V], fn func() (V, error)) {
+	defer func() {
+		g.mutex.Lock()
+		delete(g.calls, key)
+		g.mutex.Unlock()
+		close(call.done)
+	}()
+	call.value, call.err = fn()
+}
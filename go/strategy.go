@@ -0,0 +1,53 @@
+package main
+
+import (
+	"database/sql"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// Search strategies the service can run. "auto" is not a strategy itself;
+// it picks an ordered list of strategies from the shape of the query.
+const (
+	strategyFulltext = "fulltext"
+	strategyLike     = "like"
+	modeAuto         = "auto"
+)
+
+// identifierPattern matches tokens that look like codes or reference
+// numbers ("GB0000", "12345", "SC-1042") rather than words.
+var identifierPattern = regexp.MustCompile(`^[a-z]*[0-9][a-z0-9/-]*$`)
+
+// searchStrategies returns the strategies to try for a request, in order.
+// Explicit modes run as requested. In auto mode, identifiers and tokens
+// shorter than InnoDB's minimum fulltext token size go to LIKE first,
+// since FULLTEXT would never match them; everything else goes to FULLTEXT
+// first. The other strategy is kept as a fallback for empty results.
+func searchStrategies(mode, query string, minTokenSize int) []string {
+	switch mode {
+	case strategyFulltext:
+		return []string{strategyFulltext}
+	case modeAuto:
+	default:
+		return []string{strategyLike}
+	}
+
+	for _, token := range strings.Fields(strings.ToLower(query)) {
+		if identifierPattern.MatchString(token) || len([]rune(token)) < minTokenSize {
+			return []string{strategyLike, strategyFulltext}
+		}
+	}
+	return []string{strategyFulltext, strategyLike}
+}
+
+// detectMinTokenSize reads innodb_ft_min_token_size from the server,
+// falling back to the InnoDB default when it can't be read.
+func detectMinTokenSize(db *sql.DB) int {
+	var size int
+	if err := db.QueryRow("SELECT @@innodb_ft_min_token_size").Scan(&size); err != nil {
+		slog.Warn("Could not read innodb_ft_min_token_size, assuming 3", "error", err)
+		return 3
+	}
+	return size
+}
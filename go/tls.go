@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSSettings configures the HTTPS listener. ClientCA turns on mutual TLS:
+// clients must present a certificate signed by it, or may when
+// ClientAuth is "optional".
+type TLSSettings struct {
+	CertFile   string
+	KeyFile    string
+	MinVersion string // "1.2" or "1.3"
+	Ciphers    string // "modern" or "compatible"
+	ClientCA   string
+	ClientAuth string // "require" or "optional"
+}
+
+// modernCiphers are the TLS 1.2 suites with forward secrecy and AEAD.
+// TLS 1.3 suites are not configurable and always allowed.
+var modernCiphers = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// certReloader serves the certificate and client CA from disk, reloading
+// them when the files change, so renewed certificates are picked up
+// without a restart.
+type certReloader struct {
+	settings TLSSettings
+	base     *tls.Config
+
+	mutex    sync.RWMutex
+	config   *tls.Config
+	modTimes map[string]time.Time
+}
+
+// newTLSConfig builds the listener's TLS config and starts watching the
+// certificate files every interval.
+func newTLSConfig(settings TLSSettings, interval time.Duration) (*tls.Config, error) {
+	base := &tls.Config{MinVersion: tls.VersionTLS12}
+	switch settings.MinVersion {
+	case "", "1.2":
+	case "1.3":
+		base.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("unsupported TLS minimum version %q", settings.MinVersion)
+	}
+	switch settings.Ciphers {
+	case "", "modern":
+		base.CipherSuites = modernCiphers
+	case "compatible":
+		// Go's defaults
+	default:
+		return nil, fmt.Errorf("unknown TLS cipher policy %q", settings.Ciphers)
+	}
+	if settings.ClientCA != "" {
+		switch settings.ClientAuth {
+		case "", "require":
+			base.ClientAuth = tls.RequireAndVerifyClientCert
+		case "optional":
+			base.ClientAuth = tls.VerifyClientCertIfGiven
+		default:
+			return nil, fmt.Errorf("unknown TLS client auth mode %q", settings.ClientAuth)
+		}
+	}
+
+	r := &certReloader{settings: settings, base: base}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	go r.watch(interval)
+
+	return &tls.Config{
+		MinVersion: base.MinVersion,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mutex.RLock()
+			defer r.mutex.RUnlock()
+			return r.config, nil
+		},
+	}, nil
+}
+
+func (r *certReloader) files() []string {
+	files := []string{r.settings.CertFile, r.settings.KeyFile}
+	if r.settings.ClientCA != "" {
+		files = append(files, r.settings.ClientCA)
+	}
+	return files
+}
+
+// load reads the certificate, key and client CA and swaps them in.
+func (r *certReloader) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("failed to read TLS file: %v", err)
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.settings.CertFile, r.settings.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	config := r.base.Clone()
+	config.Certificates = []tls.Certificate{cert}
+
+	if r.settings.ClientCA != "" {
+		pem, err := os.ReadFile(r.settings.ClientCA)
+		if err != nil {
+			return fmt.Errorf("failed to read TLS client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in TLS client CA %s", r.settings.ClientCA)
+		}
+		config.ClientCAs = pool
+	}
+
+	r.mutex.Lock()
+	r.config = config
+	r.modTimes = modTimes
+	r.mutex.Unlock()
+	return nil
+}
+
+// changed reports whether any of the files has been modified since it was
+// last loaded.
+func (r *certReloader) changed() bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(r.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch reloads the files whenever they change. A failed reload keeps the
+// previous certificate, since a renewal may replace the certificate and
+// key a moment apart.
+func (r *certReloader) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !r.changed() {
+			continue
+		}
+		if err := r.load(); err != nil {
+			slog.Warn("TLS reload failed, keeping the current certificate", "error", err)
+			continue
+		}
+		slog.Info("Reloaded TLS certificate", "path", r.settings.CertFile)
+	}
+}
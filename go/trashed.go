@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Which soft-deleted rows a search returns, mirroring Laravel's
+// SoftDeletes: none by default, or with_trashed / only_trashed.
+const (
+	trashedExclude = ""
+	trashedWith    = "with"
+	trashedOnly    = "only"
+)
+
+var errTrashedConflict = errors.New("with_trashed and only_trashed can't both be set")
+
+// trashed returns which soft-deleted rows the request asks for.
+func (r SearchRequest) trashed() (string, error) {
+	switch {
+	case r.WithTrashed && r.OnlyTrashed:
+		return trashedExclude, errTrashedConflict
+	case r.OnlyTrashed:
+		return trashedOnly, nil
+	case r.WithTrashed:
+		return trashedWith, nil
+	default:
+		return trashedExclude, nil
+	}
+}
+
+// softDeletePredicate returns the SQL condition selecting the requested
+// rows, or "" when the table has no soft delete column or the caller wants
+// trashed rows too.
+func softDeletePredicate(tableConfig *TableConfig, trashed string) string {
+	if tableConfig.SoftDeleteColumn == "" {
+		return ""
+	}
+	switch trashed {
+	case trashedWith:
+		return ""
+	case trashedOnly:
+		return fmt.Sprintf("%s IS NOT NULL", tableConfig.SoftDeleteColumn)
+	default:
+		return fmt.Sprintf("%s IS NULL", tableConfig.SoftDeleteColumn)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// hotSearch is a search worth replaying after a restart, with how often it
+// was requested since the last snapshot.
+type hotSearch struct {
+	Request SearchRequest `json:"request"`
+	Scope   SearchScope   `json:"scope"`
+	Hits    int64         `json:"hits"`
+}
+
+// cacheSnapshot is the file written by HotSearches. Only the searches are
+// kept, not their results, which would be stale by the time they are read.
+type cacheSnapshot struct {
+	SavedAt  time.Time   `json:"saved_at"`
+	Searches []hotSearch `json:"searches"`
+}
+
+// HotSearches counts requests per cache key so the most popular searches
+// can be written to disk and replayed to warm the cache on the next start.
+// Counts are halved after every snapshot so the ranking follows recent
+// traffic rather than all-time totals.
+type HotSearches struct {
+	path     string
+	limit    int
+	searches map[string]*hotSearch
+	mutex    sync.Mutex
+}
+
+func NewHotSearches(path string, limit int) *HotSearches {
+	return &HotSearches{
+		path:     path,
+		limit:    limit,
+		searches: make(map[string]*hotSearch),
+	}
+}
+
+// Record counts one request for key.
+func (h *HotSearches) Record(key string, req SearchRequest, scope SearchScope) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if search, found := h.searches[key]; found {
+		search.Hits++
+		return
+	}
+	req.Explain = false
+	h.searches[key] = &hotSearch{Request: req, Scope: scope, Hits: 1}
+
+	// Long-tail queries would otherwise grow the map without bound
+	if len(h.searches) > h.limit*4 {
+		h.trim(h.limit * 2)
+	}
+}
+
+// Top returns up to limit searches, most requested first.
+func (h *HotSearches) Top() []hotSearch {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.top(h.limit)
+}
+
+func (h *HotSearches) top(n int) []hotSearch {
+	top := make([]hotSearch, 0, len(h.searches))
+	for _, search := range h.searches {
+		top = append(top, *search)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		return top[i].Hits > top[j].Hits
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// trim keeps the n most requested searches; the caller must hold the lock.
+func (h *HotSearches) trim(n int) {
+	keep := make(map[string]bool, n)
+	for _, search := range h.top(n) {
+		keep[canonicalSearch(search.Request, search.Scope).Key()] = true
+	}
+	for key := range h.searches {
+		if !keep[key] {
+			delete(h.searches, key)
+		}
+	}
+}
+
+// Snapshot writes the hottest searches to disk and decays the counts.
+func (h *HotSearches) Snapshot() error {
+	h.mutex.Lock()
+	snapshot := cacheSnapshot{SavedAt: time.Now(), Searches: h.top(h.limit)}
+	for key, search := range h.searches {
+		search.Hits /= 2
+		if search.Hits == 0 {
+			delete(h.searches, key)
+		}
+	}
+	h.mutex.Unlock()
+
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(h.path), 0755); err != nil {
+		return fmt.Errorf("failed to create snapshot directory: %v", err)
+	}
+	tmp := h.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write cache snapshot: %v", err)
+	}
+	return os.Rename(tmp, h.path)
+}
+
+// Load reads the last snapshot back in, seeding the counts so a restart
+// does not forget which searches were hot. A missing file is not an error.
+func (h *HotSearches) Load() ([]hotSearch, error) {
+	data, err := os.ReadFile(h.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache snapshot: %v", err)
+	}
+	var snapshot cacheSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to parse cache snapshot %s: %v", h.path, err)
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, search := range snapshot.Searches {
+		search := search
+		h.searches[canonicalSearch(search.Request, search.Scope).Key()] = &search
+	}
+	if len(snapshot.Searches) > h.limit {
+		snapshot.Searches = snapshot.Searches[:h.limit]
+	}
+	return snapshot.Searches, nil
+}
+
+// Run snapshots every interval until ctx is done.
+func (h *HotSearches) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := h.Snapshot(); err != nil {
+				slog.Warn("Cache snapshot failed", "error", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// warmCache replays searches through run with at most concurrency running
+// at once, and returns how many succeeded. It stops starting new searches
+// once ctx is done.
+func warmCache(ctx context.Context, searches []hotSearch, concurrency int, run func(ctx context.Context, req SearchRequest, scope SearchScope) error) int {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	warmed := 0
+
+	for _, search := range searches {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return warmed
+		}
+
+		wg.Add(1)
+		go func(req SearchRequest, scope SearchScope) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			if err := run(ctx, req, scope); err != nil {
+				slog.Warn("Warm-up search failed", "table", req.Table, queryAttr("query", req.Query), "error", err)
+				return
+			}
+			mutex.Lock()
+			warmed++
+			mutex.Unlock()
+		}(search.Request, search.Scope)
+	}
+	wg.Wait()
+	return warmed
+}
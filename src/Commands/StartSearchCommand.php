@@ -3,6 +3,7 @@
 namespace GalenAltaiir\LightningSearch\Commands;
 
 use Illuminate\Console\Command;
+use Illuminate\Support\Facades\Config;
 use Illuminate\Support\Facades\File;
 use Symfony\Component\Process\Process;
 
@@ -21,6 +22,8 @@ public function handle()
             return 1;
         }
 
+        $this->exportConfig();
+
         $process = new Process([$binaryPath]);
         $process->setTimeout(null);
 
@@ -42,4 +45,41 @@ public function handle()
 
         return $process->getExitCode();
     }
+
+    /**
+     * Write the settings the service reads from config/lightning-search.php
+     * to storage/app/lightning-search/config.json.
+     */
+    protected function exportConfig(): void
+    {
+        $path = storage_path('app/lightning-search/config.json');
+
+        $keys = collect(Config::get('lightning-search.auth.keys', []))
+            ->filter(fn ($key) => !empty($key['key']))
+            ->values()
+            ->all();
+
+        File::ensureDirectoryExists(dirname($path));
+        $tables = [];
+        foreach (Config::get('lightning-search.models', []) as $modelClass => $settings) {
+            $model = new $modelClass;
+            $tables[$model->getSearchableTable()] = [
+                'searchable_fields' => $model->getSearchableFields(),
+                'index_fields' => $model->getIndexFields(),
+                'primary_key' => $model->getKeyName(),
+                'tenant_column' => $settings['tenant_column'] ?? null,
+                'constraint_columns' => $settings['constraint_columns'] ?? [],
+                'soft_delete_column' => $settings['soft_delete_column']
+                    ?? (method_exists($model, 'getDeletedAtColumn') ? $model->getDeletedAtColumn() : null),
+            ];
+        }
+
+        File::put($path, json_encode([
+            'keys' => $keys,
+            'cors' => Config::get('lightning-search.cors', []),
+            'tables' => (object) $tables,
+        ], JSON_PRETTY_PRINT | JSON_UNESCAPED_SLASHES));
+        // The file holds API keys
+        chmod($path, 0600);
+    }
 }
@@ -5,12 +5,61 @@
 use GalenAltaiir\LightningSearch\Contracts\Searchable;
 use Illuminate\Database\Eloquent\Builder;
 use Illuminate\Database\Eloquent\Model;
+use Illuminate\Database\Eloquent\SoftDeletingScope;
+use Illuminate\Http\Client\PendingRequest;
 use Illuminate\Support\Facades\Http;
+use Closure;
 use Illuminate\Support\Facades\Config;
+use Psr\Http\Message\RequestInterface;
 use RuntimeException;
 
 class LightningSearch
 {
+    /**
+     * The callback that resolves the current tenant for a search.
+     *
+     * @var \Closure|null
+     */
+    protected $tenantResolver;
+
+    /**
+     * The callback that resolves the access constraints for a search.
+     *
+     * @var \Closure|null
+     */
+    protected $constraintResolver;
+
+    /**
+     * Register the callback that resolves the current tenant. Its result is
+     * sent to the Go service as a signed claim, and searches on tables with
+     * a tenant_column only return that tenant's records.
+     *
+     * @param  \Closure(\GalenAltaiir\LightningSearch\Contracts\Searchable): (int|string|null)  $callback
+     * @return $this
+     */
+    public function resolveTenantUsing(Closure $callback)
+    {
+        $this->tenantResolver = $callback;
+
+        return $this;
+    }
+
+    /**
+     * Register the callback that resolves what the current user may see,
+     * as a map of column to allowed values, e.g. ['region' => ['eu']].
+     * The constraints are signed and the Go service adds them to every
+     * query; each column must be listed in the model's constraint_columns.
+     *
+     * @param  \Closure(\GalenAltaiir\LightningSearch\Contracts\Searchable): (array<string, array>|null)  $callback
+     * @return $this
+     */
+    public function constrainSearchesUsing(Closure $callback)
+    {
+        $this->constraintResolver = $callback;
+
+        return $this;
+    }
+
     /**
      * Search using the model's query builder.
      *
@@ -50,18 +99,22 @@ public function search(Builder $query, string $search, ?string $mode = null)
     protected function searchWithGo(Builder $query, string $search, Searchable $model)
     {
         try {
-            $response = Http::post($this->getGoServiceUrl() . '/search', [
+            $response = $this->client()->withHeaders($this->claimHeaders($model))->post($this->getGoServiceUrl() . '/search', [
                 'table' => $model->getSearchableTable(),
                 'query' => $search,
-                'mode' => 'fulltext', // Default to fulltext search for Go service
-            ]);
+                'mode' => Config::get('lightning-search.service.strategy', 'auto'),
+            ] + $this->trashedOptions($query));
 
             if (!$response->successful()) {
                 // Fallback to Eloquent if Go service fails
                 if (Config::get('lightning-search.modes.fallback') === 'eloquent') {
                     return $this->searchWithEloquent($query, $search, $model);
                 }
-                throw new RuntimeException('Go search service request failed: ' . $response->body());
+                throw new RuntimeException(sprintf(
+                    'Go search service request %s failed: %s',
+                    $response->header('X-Request-ID'),
+                    $response->body()
+                ));
             }
 
             $data = $response->json();
@@ -80,6 +133,28 @@ protected function searchWithGo(Builder $query, string $search, Searchable $mode
         }
     }
 
+    /**
+     * Drop cached Go service results for a model's table, or only those
+     * containing the given records.
+     *
+     * @param  \GalenAltaiir\LightningSearch\Contracts\Searchable  $model
+     * @param  array<int|string>  $ids
+     * @return int
+     */
+    public function invalidate(Searchable $model, array $ids = []): int
+    {
+        $response = $this->client()->post($this->getGoServiceUrl() . '/cache/invalidate', [
+            'table' => $model->getSearchableTable(),
+            'ids' => array_map('strval', $ids),
+        ]);
+
+        if (!$response->successful()) {
+            throw new RuntimeException('Go search service cache invalidation failed: ' . $response->body());
+        }
+
+        return $response->json('invalidated', 0);
+    }
+
     /**
      * Search using Eloquent's where clauses.
      *
@@ -97,6 +172,167 @@ protected function searchWithEloquent(Builder $query, string $search, Searchable
         });
     }
 
+    /**
+     * Get the request options matching the query's withTrashed() or
+     * onlyTrashed() call, so the service returns the same rows Eloquent
+     * would.
+     *
+     * @param  \Illuminate\Database\Eloquent\Builder  $query
+     * @return array<string, bool>
+     */
+    protected function trashedOptions(Builder $query): array
+    {
+        $model = $query->getModel();
+
+        if (!method_exists($model, 'getQualifiedDeletedAtColumn')
+            || !in_array(SoftDeletingScope::class, $query->removedScopes())) {
+            return [];
+        }
+
+        // onlyTrashed() removes the scope and adds a whereNotNull
+        $column = $model->getQualifiedDeletedAtColumn();
+        foreach ($query->getQuery()->wheres as $where) {
+            if ($where['type'] === 'NotNull' && $where['column'] === $column) {
+                return ['only_trashed' => true];
+            }
+        }
+
+        return ['with_trashed' => true];
+    }
+
+    /**
+     * Get the signed claims header describing who the search is for.
+     *
+     * @param  \GalenAltaiir\LightningSearch\Contracts\Searchable  $model
+     * @return array<string, string>
+     */
+    protected function claimHeaders(Searchable $model): array
+    {
+        $claims = [];
+
+        // Only models exported with scoping columns are scoped; the service
+        // refuses claims for any other table
+        $settings = Config::get('lightning-search.models.' . get_class($model), []);
+
+        if (!empty($settings['tenant_column']) && $this->tenantResolver && ($tenant = ($this->tenantResolver)($model)) !== null) {
+            $claims['tenant'] = (string) $tenant;
+        }
+
+        if (!empty($settings['constraint_columns']) && $this->constraintResolver && ($constraints = ($this->constraintResolver)($model))) {
+            $claims['constraints'] = array_map(function ($values) {
+                return array_map('strval', array_values((array) $values));
+            }, $constraints);
+        }
+
+        if (empty($claims)) {
+            return [];
+        }
+
+        $secret = Config::get('lightning-search.service.claims_secret')
+            ?: Config::get('lightning-search.service.signing_secret');
+
+        if (!$secret) {
+            throw new RuntimeException('Set LIGHTNING_SEARCH_CLAIMS_SECRET to send tenant or constraint claims to the Go search service.');
+        }
+
+        // Claims only need to outlive the request they are sent with
+        $claims['exp'] = time() + 60;
+        $payload = json_encode($claims);
+
+        return [
+            'X-Lightning-Claims' => $this->base64Url($payload) . '.' . $this->base64Url(hash_hmac('sha256', $payload, $secret, true)),
+        ];
+    }
+
+    /**
+     * Encode a string as unpadded base64url.
+     *
+     * @param  string  $value
+     * @return string
+     */
+    protected function base64Url(string $value): string
+    {
+        return rtrim(strtr(base64_encode($value), '+/', '-_'), '=');
+    }
+
+    /**
+     * Get an HTTP client for the Go service, authenticated with the
+     * configured API key and signed with the shared secret.
+     *
+     * @return \Illuminate\Http\Client\PendingRequest
+     */
+    protected function client(): PendingRequest
+    {
+        $request = Http::acceptJson()->withOptions($this->tlsOptions());
+
+        if ($key = Config::get('lightning-search.service.key')) {
+            $request->withToken($key);
+        }
+
+        // Let the service log under the same request ID as the app
+        if (!app()->runningInConsole() && ($requestId = request()->header('X-Request-ID'))) {
+            $request->withHeaders(['X-Request-ID' => $requestId]);
+        }
+
+        if ($secret = Config::get('lightning-search.service.signing_secret')) {
+            $request->withRequestMiddleware(fn (RequestInterface $request) => $this->sign($request, $secret));
+        }
+
+        return $request;
+    }
+
+    /**
+     * Add an HMAC-SHA256 signature covering the method, path, body and a
+     * timestamp and nonce, so the service can reject altered or replayed
+     * requests.
+     *
+     * @param  \Psr\Http\Message\RequestInterface  $request
+     * @param  string  $secret
+     * @return \Psr\Http\Message\RequestInterface
+     */
+    protected function sign(RequestInterface $request, string $secret): RequestInterface
+    {
+        $uri = $request->getUri();
+        $path = $uri->getPath() . ($uri->getQuery() !== '' ? '?' . $uri->getQuery() : '');
+        $timestamp = (string) time();
+        $nonce = bin2hex(random_bytes(16));
+
+        $payload = implode("\n", [
+            $request->getMethod(),
+            $path,
+            $timestamp,
+            $nonce,
+            hash('sha256', (string) $request->getBody()),
+        ]);
+
+        return $request
+            ->withHeader('X-Lightning-Timestamp', $timestamp)
+            ->withHeader('X-Lightning-Nonce', $nonce)
+            ->withHeader('X-Lightning-Signature', hash_hmac('sha256', $payload, $secret));
+    }
+
+    /**
+     * Get the Guzzle options for verifying the service's certificate and
+     * presenting our own for mutual TLS.
+     *
+     * @return array<string, mixed>
+     */
+    protected function tlsOptions(): array
+    {
+        $options = [];
+
+        if ($ca = Config::get('lightning-search.tls.client.ca')) {
+            $options['verify'] = $ca;
+        }
+
+        if ($cert = Config::get('lightning-search.tls.client.cert')) {
+            $options['cert'] = $cert;
+            $options['ssl_key'] = Config::get('lightning-search.tls.client.key');
+        }
+
+        return $options;
+    }
+
     /**
      * Get the URL for the Go search service.
      *
@@ -104,9 +340,10 @@ protected function searchWithEloquent(Builder $query, string $search, Searchable
      */
     protected function getGoServiceUrl(): string
     {
+        $scheme = Config::get('lightning-search.service.scheme', 'http');
         $host = Config::get('lightning-search.service.host', '127.0.0.1');
         $port = Config::get('lightning-search.service.port', 8081);
 
-        return "http://{$host}:{$port}";
+        return "{$scheme}://{$host}:{$port}";
     }
 }